@@ -1,4 +1,5 @@
 // single-writer in-memory B+ tree implementation
+// persistent: Clone shares nodes, writers copy on write
 // Copyright Jan 2017
 // Author: Abhijeet Gole
 
@@ -23,10 +24,18 @@ type items []Item	// slice of keys
 type values []string	// slice of values
 
 // tree
+// nodes are shared between a tree and its clones, a tree only
+// modifies nodes it owns and copies the others on the way down
 type Bptree struct {
 	degree	int
 	length	int
 	root	*node
+	owner	*owner
+}
+
+// write token of a tree version
+type owner struct {
+	_ byte
 }
 
 // tree node
@@ -36,9 +45,16 @@ type node struct {
 	keys	items
 	children children
 	vals	values
-	parent	*node
-	prev	*node
-	next	*node
+	owner	*owner
+}
+
+// position in the leaf level: internal nodes on the path
+// from root with child index taken, then leaf and key index
+type cursor struct {
+	path	[]*node
+	pidx	[]int
+	leaf	*node
+	idx	int
 }
 
 // find idx in key slice where key should insert
@@ -56,378 +72,294 @@ func (k *items) find (key Item) (index int, found bool) {
 	return i, false
 }
 
-// recursive search for Leaf where key ought to reside
-func (n *node) findLeaf(key Item) *node {
-	if !n.leaf {
-		var i int
-		for i=0; i<len(n.keys); i++ {
-			switch {
-			case key < n.keys[i]:
-			// search child i+1
-				n = n.children[i]
-				n = n.findLeaf(key)
-				return n
-			case key > n.keys[i]:
-			// skip to next entry	
-			default:
-			// search child i+1
-				n = n.children[i+1]
-				return n.findLeaf(key)
-			}
+// index of child where key ought to reside
+// child i holds keys < keys[i], child i+1 keys >= keys[i]
+func (n *node) childIdx(key Item) int {
+	var i int
+	for i=0; i < len(n.keys); i++ {
+		if key < n.keys[i] {
+			break
 		}
-		n = n.children[i]
-		return n.findLeaf(key)
+	}
+	return i
+}
+
+// search for Leaf where key ought to reside
+func (n *node) findLeaf(key Item) *node {
+	for !n.leaf {
+		n = n.children[n.childIdx(key)]
 	}
 	return n
 }
 
-// find N next larger keys and return their values
-func (n *node) getNextN(key Item, N int) []string {
-	// first find the leaf node
+// find key,value starting at leaf
+func (n *node) get(key Item) (string, bool) {
 	n = n.findLeaf(key)
 	idx, found := n.keys.find(key)
 	if found {
-		idx+=1
+		return n.vals[idx], true
 	}
-	var nextN []string
+	return "", false
+}
 
-	// traverse leaf link list until N copied
-	for i:=0; i<N;  {
-		if idx < len(n.keys) {
-			nextN = append(nextN, n.vals[idx])
-			idx++
-			i++
-		} else {
-			n = n.next
-			idx = 0
-		}
+// node owned by tree: n itself or a copy of n
+func (tree *Bptree) own(n *node) *node {
+	if n.owner == tree.owner {
+		return n
 	}
-	return nextN
+	nn := &node{leaf: n.leaf, level: n.level, owner: tree.owner}
+	nn.keys = make(items, len(n.keys))
+	copy(nn.keys, n.keys)
+	if n.leaf {
+		nn.vals = make(values, len(n.vals))
+		copy(nn.vals, n.vals)
+	} else {
+		nn.children = make(children, len(n.children))
+		copy(nn.children, n.children)
+	}
+	return nn
 }
 
-// find key,value starting at leaf
-func (n *node) get(key Item) string {
-	n = n.findLeaf(key)
-	idx, found := n.keys.find(key)
-	if found {
-		return n.vals[idx]
-	}
-	return ""
+// owned copy of child i, linked into n
+func (tree *Bptree) ownChild(n *node, i int) *node {
+	c := tree.own(n.children[i])
+	n.children[i] = c
+	return c
 }
 
-// return sibling node ptr
-func (n *node) sibling() *node {
-	p := n.prev
-	q := n.next
-	// if pointing to itself, then no sibling
-	if p == n {
-		return nil
+// position cursor at first key greater than key
+// wraps to the first leaf when no key is greater
+func (n *node) seek(key Item) *cursor {
+	c := new(cursor)
+	for !n.leaf {
+		i := n.childIdx(key)
+		c.path = append(c.path, n)
+		c.pidx = append(c.pidx, i)
+		n = n.children[i]
 	}
-	// check prev node first
-	if n.parent == p.parent && p.keys[0] < n.keys[0] {
-		return p
+	c.leaf = n
+	idx, found := n.keys.find(key)
+	if found {
+		idx+=1
 	}
-	if n.parent == q.parent && q.keys[0] > n.keys[0] {
-		return q
+	c.idx = idx
+	if idx == len(n.keys) {
+		c.nextLeaf()
 	}
-	return nil
+	return c
 }
 
-// remove key,value pair from leaf
-func (n *node) removeKey(idx int) *node {
-	nks := make(items, len(n.keys)-1)
-	nvs := make([]string, len(n.vals)-1)
-	if idx == 0 {
-		copy(nks, n.keys[idx+1:])
-		n.keys = nks
-		copy(nvs, n.vals[idx+1:])
-		n.vals = nvs
-	} else {
-		copy(nks, n.keys[:idx])
-		copy(nks[idx:], n.keys[idx+1:])
-		n.keys = nks
-		copy(nvs, n.vals[:idx])
-		copy(nvs[idx:], n.vals[idx+1:])
-		n.vals = nvs
+// position cursor at min key
+func (n *node) first() *cursor {
+	c := new(cursor)
+	for !n.leaf {
+		c.path = append(c.path, n)
+		c.pidx = append(c.pidx, 0)
+		n = n.children[0]
 	}
-	if len(n.keys) == 0 {
-		return nil
+	c.leaf = n
+	return c
+}
+
+// advance cursor one key, wraps around
+func (c *cursor) next() {
+	c.idx++
+	if c.idx == len(c.leaf.keys) {
+		c.nextLeaf()
 	}
-	return n
 }
 
-// redistribute key,vals
-// sib has more keys
-func (n *node) redistribLeaf(sib *node, maxk int) {
-	if n.keys[0] > sib.keys[0] {
-		// redistribute len(sib)-maxk/2 keys from sib into n
-		sks := make(items, maxk/2)
-		copy(sks, sib.keys[:maxk/2])
-		nks := make(items, len(sib.keys)-maxk/2)
-		copy(nks, sib.keys[maxk/2:])
-		nks = append(nks, n.keys...)
-		n.keys = nks
-		sib.keys = sks
-		svs := make([]string, maxk/2)
-		// redistribute len(sib)-maxk/2 vals from sib into n
-		copy(svs, sib.vals[:maxk/2])
-		nvs := make([]string, len(sib.vals)-maxk/2)
-		copy(nvs, sib.vals[maxk/2:])
-		nvs = append(nvs, n.vals...)
-		n.vals = nvs
-		sib.vals = svs
-	} else {
-		// redistribute up to max/2 k,v from sib into n
-		nks := make(items, len(n.keys))
-		copy(nks, n.keys)
-		nks = append(nks, sib.keys[:maxk/2]...)
-		n.keys = nks
-		nvs := make([]string, len(n.vals))
-		copy(nvs, n.vals)
-		nvs = append(nvs, sib.vals[:maxk/2]...)
-		n.vals = nvs
-		// shift remaining k,v in the sib node
-		nks = make(items, len(sib.keys)-maxk/2)
-		copy(nks, sib.keys[maxk/2:])
-		sib.keys = nks
-		nvs = make([]string, len(sib.vals)-maxk/2)
-		copy(nvs, sib.vals[maxk/2:])
-		sib.vals = nvs
-	}
-}
-
-// fix key in parent internal node after children keys are redistrib'd
-func (n *node) fixup(sib *node) {
-	for i:=0; i < len(n.children); i++ {
-		if n.children[i] == sib {
-			if i == 0 {
-				return
-			}
-			n.keys[i-1] = n.children[i].minKey()
+// move cursor to first key of the following leaf
+// the leaf after the last leaf is the first leaf
+func (c *cursor) nextLeaf() {
+	d := len(c.path)-1
+	// climb to the lowest node with a child to the right
+	for d >= 0 && c.pidx[d] == len(c.path[d].children)-1 {
+		d--
+	}
+	if d < 0 {
+		if len(c.path) == 0 {
+			// single leaf
+			c.idx = 0
 			return
 		}
+		d = 0
+		c.pidx[0] = 0
+	} else {
+		c.pidx[d]++
+	}
+	// descend leftmost
+	n := c.path[d].children[c.pidx[d]]
+	for d++; d < len(c.path); d++ {
+		c.path[d] = n
+		c.pidx[d] = 0
+		n = n.children[0]
 	}
+	c.leaf = n
+	c.idx = 0
 }
 
-// replace sib with n in parent "p" 
-// during merging of two siblings after key delete
-func (p *node) replaceChild(root, n, sib *node, maxk int) *node {
-	sibIdx := -1
-	nIdx := -1
-	// find positions of n & sib
-	for i:=0; i < len(p.children); i++ {
-		if p.children[i] == sib {
-			sibIdx = i
-		}
-		if p.children[i] == n {
-			nIdx = i
-		}
-		if sibIdx >= 0 && nIdx >= 0 {
-			break
-		}
+// step cursor back one key, wraps around
+func (c *cursor) prev() {
+	if c.idx > 0 {
+		c.idx--
+		return
 	}
-	pks := make(items, len(p.keys)-1)
-	pcs := make([]*node, len(p.children)-1)
-	if nIdx < sibIdx {
-		if sibIdx > len(p.keys) {
-			// just remove sib by truncation
-			copy(pks, p.keys[:nIdx])
-			p.keys = pks
-			copy(pcs, p.children[:sibIdx])
-			p.children = pcs
-		} else {
-			// remove child sib by shifting all children left
-			copy(pks, p.keys[:nIdx])
-			copy(pks[nIdx:], p.keys[sibIdx:])
-			p.keys = pks
-			copy(pcs, p.children[:sibIdx])
-			copy(pcs[sibIdx:], p.children[sibIdx+1:])
-			p.children = pcs
-		}
-	} else  {
-		if nIdx > len(p.keys) {
-			// replace sib by n
-			p.children[sibIdx] = n
-			pks[len(p.keys)-2] = n.keys[0]
-			p.keys = pks
-			copy(pcs, p.children[:nIdx])
-			p.children = pcs
-		} else {
-			// replace child sib and shift all children left
-			copy(pks, p.keys[nIdx:])
-			p.keys = pks
-			copy(pcs, p.children[:nIdx])
-			copy(pcs[nIdx:], p.children[nIdx+1:])
-			p.children = pcs
+	c.prevLeaf()
+}
+
+// move cursor to last key of the preceding leaf
+// the leaf before the first leaf is the last leaf
+func (c *cursor) prevLeaf() {
+	d := len(c.path)-1
+	// climb to the lowest node with a child to the left
+	for d >= 0 && c.pidx[d] == 0 {
+		d--
+	}
+	if d < 0 {
+		if len(c.path) == 0 {
+			// single leaf
+			c.idx = len(c.leaf.keys)-1
+			return
 		}
+		d = 0
+		c.pidx[0] = len(c.path[0].children)-1
+	} else {
+		c.pidx[d]--
 	}
-	// fix parent links
-	for i:=0; i < len(p.children); i++ {
-		p.children[i].parent = p
+	// descend rightmost
+	n := c.path[d].children[c.pidx[d]]
+	for d++; d < len(c.path); d++ {
+		c.path[d] = n
+		c.pidx[d] = len(n.children)-1
+		n = n.children[len(n.children)-1]
 	}
-	if len(p.keys) < maxk/2 {
-		if len(p.keys) == 0 {
-			p.children[0].parent = nil
-			return p.children[0]
-		}
-		psib := p.sibling()
-		if psib == nil {
-			// no sibling=> p is root
-			return p
-		}
-		r := p.mergeSib(root, psib, maxk)
-		if r != root {
-			return r
+	c.leaf = n
+	c.idx = len(n.keys)-1
+}
+
+// key,value under cursor
+func (c *cursor) item() (Item, string) {
+	return c.leaf.keys[c.idx], c.leaf.vals[c.idx]
+}
+
+// remove key,value pair from leaf
+func (n *node) removeKey(idx int) {
+	nks := make(items, len(n.keys)-1)
+	copy(nks, n.keys[:idx])
+	copy(nks[idx:], n.keys[idx+1:])
+	n.keys = nks
+	nvs := make(values, len(n.vals)-1)
+	copy(nvs, n.vals[:idx])
+	copy(nvs[idx:], n.vals[idx+1:])
+	n.vals = nvs
+}
+
+// remove key idx and child idx+1 from internal node
+func (n *node) removeDir(idx int) {
+	nks := make(items, len(n.keys)-1)
+	copy(nks, n.keys[:idx])
+	copy(nks[idx:], n.keys[idx+1:])
+	n.keys = nks
+	ncs := make(children, len(n.children)-1)
+	copy(ncs, n.children[:idx+1])
+	copy(ncs[idx+1:], n.children[idx+2:])
+	n.children = ncs
+}
+
+// delete key from subtree of owned node n
+// rebalances children that fall below maxk/2 keys
+func (tree *Bptree) del(n *node, key Item) (bool, string) {
+	if n.leaf {
+		idx, found := n.keys.find(key)
+		if !found {
+			return false, ""
 		}
+		retval := n.vals[idx]
+		n.removeKey(idx)
+		return true, retval
+	}
+	i := n.childIdx(key)
+	c := tree.ownChild(n, i)
+	found, retval := tree.del(c, key)
+	if found && len(c.keys) < tree.degree/2 {
+		tree.rebalance(n, i)
 	}
-	return root
-}
-
-// merge node with sibling and insert new child into parent
-// return new root if merge propagate to root
-func (n *node) mergeSib(root *node, sib *node, maxk int) *node {
-	var A, B *node
-
-	if sib.keys[0] > n.keys[0] {
-		// merge sib into n
-		if n.leaf {
-			// copy keys,values
-			nks := make(items, len(n.keys))
-			copy(nks, n.keys)
-			nks = append(nks, sib.keys...)
-			n.keys = nks
-			nvs := make([]string, len(n.vals))
-			copy(nvs, n.vals)
-			nvs = append(nvs, sib.vals...)
-			n.vals = nvs
+	return found, retval
+}
+
+// refill child i of owned node p from a sibling:
+// borrow one entry if the sibling can spare it, else merge
+func (tree *Bptree) rebalance(p *node, i int) {
+	mink := tree.degree/2
+	if i > 0 {
+		left := tree.ownChild(p, i-1)
+		c := p.children[i]
+		if len(left.keys) > mink {
+			left.borrowLast(c, p, i-1)
 		} else {
-			// copy children
-			ncs := make([]*node, len(n.children))
-			copy(ncs, n.children)
-			ncs = append(ncs, sib.children...)
-			n.children = ncs
-			// fix keys
-			nks := make(items, len(n.children)-1)
-			for i:=1; i<len(n.children); i++ {
-				nks[i-1] = n.children[i].minKey()
-			}
-			n.keys = nks
-			// fix parent links
-			for i:=0; i < len(n.children); i++ {
-				n.children[i].parent = n
-			}
+			left.merge(c, p.keys[i-1])
+			p.removeDir(i-1)
 		}
-		sib.next.prev = n
-		n.next = sib.next
-		A = n
-		B = sib
+		return
+	}
+	right := tree.ownChild(p, 1)
+	c := p.children[0]
+	if len(right.keys) > mink {
+		right.borrowFirst(c, p, 0)
 	} else {
-		// merge n into sib
-		if n.leaf {
-			// copy keys,values
-			sks := make(items, len(sib.keys))
-			copy(sks, sib.keys)
-			sks = append(sks, n.keys...)
-			sib.keys = sks
-			svs := make([]string, len(sib.vals))
-			copy(svs, sib.vals)
-			svs = append(svs, n.vals...)
-			sib.vals = svs
-		} else {
-			// copy children
-			scs := make([]*node, len(sib.children))
-			copy(scs, sib.children)
-			scs = append(scs, n.children...)
-			sib.children = scs
-			// fix keys
-			sks := make(items, len(sib.children)-1)
-			for i:=1; i<len(sib.children); i++ {
-				sks[i-1] = sib.children[i].minKey()
-			}
-			sib.keys = sks
-			// fix parent links
-			for i:=0; i < len(sib.children); i++ {
-				sib.children[i].parent = sib
-			}
-		}
-		n.next.prev = sib
-		sib.next = n.next
-		A = sib
-		B = n
+		c.merge(right, p.keys[0])
+		p.removeDir(0)
 	}
-	// remove B from parent & add A to parent
-	return n.parent.replaceChild(root, A, B, maxk)
 }
 
-// delete key from tree starting at leaf
-func (n* node) del(key Item, maxk int) (bool, string, *node) {
-	root := n
-	n = n.findLeaf(key)
-	idx, found := n.keys.find(key)
-	if !found {
-		return false, "", root
+// move last entry of left sibling n to front of c
+// sep is index of separator between them in parent p
+func (n *node) borrowLast(c *node, p *node, sep int) {
+	last := len(n.keys)-1
+	if n.leaf {
+		c.keys = append(items{n.keys[last]}, c.keys...)
+		c.vals = append(values{n.vals[last]}, c.vals...)
+		p.keys[sep] = c.keys[0]
+	} else {
+		c.keys = append(items{p.keys[sep]}, c.keys...)
+		c.children = append(children{n.children[last+1]}, c.children...)
+		p.keys[sep] = n.keys[last]
+		n.children = n.children[:last+1:last+1]
 	}
-	// found key,value pair in leaf
-	retval := n.vals[idx]
-
-	// check if key deletion will lead to too few keys in node
-	if (len(n.keys)-1) < maxk/2 {
-		sib := n.sibling()
-		if sib == nil {
-			goto done
-		}
-		if len(sib.keys) > maxk/2 {
-			// remove key from n
-			n.removeKey(idx)
-			// redistribute with sibling if anything left
-			if len(n.keys) > 0 {
-				n.redistribLeaf(sib, maxk)
-			} else {
-				// delete n from link-list
-				if sib.next == n {
-					n.next.prev = sib
-					sib.next = n.next
-				} else {
-					n.prev.next = sib
-					sib.prev = n.prev
-				}
-				// remove n from parent
-				r := n.parent.replaceChild(root, sib, n, maxk)
-				if r != root {
-					return true, retval, r
-				} else {
-					return true, retval, root
-				}
-			}
-			// fixup parent key
-			if sib.keys[0] > n.keys[0] {
-				n.parent.fixup(sib)
-			} else {
-				n.parent.fixup(n)
-			}
-			return true, retval, root
-		} else {
-			//remove & merge with sibling
-			n.removeKey(idx)
-			r := n.mergeSib(root, sib, maxk)
-			if r != root {
-				return true, retval, r
-			} else {
-				return true, retval, root
-			}
-		}
+	n.keys = n.keys[:last:last]
+	if n.leaf {
+		n.vals = n.vals[:last:last]
 	}
-done:
-	// remove k,v pair
-	r := n.removeKey(idx)
-	// fixup parent key
-	if n.parent != nil {
-		n.parent.fixup(n)
+}
+
+// move first entry of right sibling n to end of c
+// sep is index of separator between them in parent p
+func (n *node) borrowFirst(c *node, p *node, sep int) {
+	if n.leaf {
+		c.keys = append(c.keys, n.keys[0])
+		c.vals = append(c.vals, n.vals[0])
+		n.keys = append(items{}, n.keys[1:]...)
+		n.vals = append(values{}, n.vals[1:]...)
+		p.keys[sep] = n.keys[0]
+	} else {
+		c.keys = append(c.keys, p.keys[sep])
+		c.children = append(c.children, n.children[0])
+		p.keys[sep] = n.keys[0]
+		n.keys = append(items{}, n.keys[1:]...)
+		n.children = append(children{}, n.children[1:]...)
 	}
-	if r == nil {
-		return true, retval, nil
+}
+
+// append right sibling r to n, sep is their separator in parent
+func (n *node) merge(r *node, sep Item) {
+	if n.leaf {
+		n.keys = append(n.keys, r.keys...)
+		n.vals = append(n.vals, r.vals...)
+		return
 	}
-	return true, retval, root
+	n.keys = append(append(n.keys, sep), r.keys...)
+	n.children = append(n.children, r.children...)
 }
 
 // return min key in the tree
@@ -451,146 +383,71 @@ func (n *node) maxKey() Item {
 // insert into Leaf node
 // may grow bigger than max degree
 // split will happen in caller
-func (n *node) insertInLeaf(key Item, value string) {
+// returns false if key was present and value replaced
+func (n *node) insertInLeaf(key Item, value string) bool {
 	idx, found := n.keys.find(key)
-	if !found {
-		if  idx < len(n.keys) {
-		// insert in beginning or middle
-			nks := make(items, len(n.keys)+1)
-			copy(nks[idx+1:], n.keys[idx:])
-			copy(nks[:idx], n.keys[:idx])
-			nks[idx] = key
-			n.keys = nks
-			n.vals = append(n.vals, "")
-			copy(n.vals[idx+1:], n.vals[idx:])
-			n.vals[idx] = value
-		} else {
-			n.vals = append(n.vals, value)
-			n.keys = append(n.keys, key)
-		}
-	} else {
-	// replace pair
-		n.keys[idx] = key
+	if found {
+		// replace pair
 		n.vals[idx] = value
-	}
+		return false
+	}
+	nks := make(items, len(n.keys)+1)
+	copy(nks, n.keys[:idx])
+	copy(nks[idx+1:], n.keys[idx:])
+	nks[idx] = key
+	n.keys = nks
+	nvs := make(values, len(n.vals)+1)
+	copy(nvs, n.vals[:idx])
+	copy(nvs[idx+1:], n.vals[idx:])
+	nvs[idx] = value
+	n.vals = nvs
+	return true
 }
 
-// insert into internal node
-// handles split on exceeding max degree
-func (n *node) insertDir(lchld *node, rchld *node, maxk int) *node {
-	newn := n
-	if len(n.keys) == 0 {
-		// insert in new parent
-		nchn := make([]*node, 2)
-		n.children = nchn
-		n.children[0] = lchld
-		n.children[1] = rchld
-		n.keys = append(n.keys, rchld.minKey())
-	} else {
-		idx, _ := n.keys.find(rchld.minKey())
-		switch idx {
-		case len(n.keys):
-			// Append rchld key
-			n.keys = append(n.keys, rchld.minKey())
-			// Append rchld @idx
-			n.children = append(n.children, rchld)
-		default:
-			// Insert rchld key @idx
-			nks := make(items, len(n.keys)+1)
-			copy(nks[idx+1:], n.keys[idx:])
-			copy(nks[:idx], n.keys[:idx])
-			nks[idx] = rchld.minKey()
-			n.keys = nks
-			// Shift children right
-			n.children = append(n.children, nil)
-			copy(n.children[idx+1:], n.children[idx:])
-			// Replace rchld @idx+1
-			n.children[idx+1] = rchld
-		}
-	}
-	if len(n.keys) > maxk {
-		// split internal node
-		newnd := n.split()
-
-		// link siblings
-		n.linkSiblings(newnd)
-
-		if n.parent == nil {
-			// create new parent of internal node
-			n.parent = new(node)
-			newnd.parent = n.parent
-			// link parent to itself
-			n.parent.prev = n.parent
-			n.parent.next = n.parent
-			n.parent.level = (n.level + 1)
-			newn = n.parent.insertDir(n, newnd, maxk)
-		} else {
-			// insert into parent of internal node
-			newnd.parent = n.parent
-			newn = n.parent.insertDir(n, newnd, maxk)
-		}
-	}
-	return newn
-}
-
-// link siblings in split
-func (n *node) linkSiblings(newnd *node) {
-	if n.prev == n {
-		n.next = newnd
-		n.prev = newnd
-		newnd.prev = n
-		newnd.next = n
-	} else if n.prev != n {
-		n.next.prev = newnd
-		newnd.prev = n
-		newnd.next = n.next
-		n.next = newnd
-	}
+// insert separator key and right child after child idx
+// may grow bigger than max degree
+// split will happen in caller
+func (n *node) insertDir(idx int, key Item, rchld *node) {
+	nks := make(items, len(n.keys)+1)
+	copy(nks, n.keys[:idx])
+	copy(nks[idx+1:], n.keys[idx:])
+	nks[idx] = key
+	n.keys = nks
+	ncs := make(children, len(n.children)+1)
+	copy(ncs, n.children[:idx+1])
+	copy(ncs[idx+2:], n.children[idx+1:])
+	ncs[idx+1] = rchld
+	n.children = ncs
 }
 
-// insert into tree starting at leaf node
-func (n *node) insert(key Item, value string, lchld *node, rchld *node, maxk int) *node {
-	var root, newroot *node
-	root = n
-
-	n = n.findLeaf(key)
-	n.insertInLeaf(key, value)
-
-	if len(n.keys) > maxk {
-		// split leaf
-		newnd := n.split()
-
-		// link siblings
-		n.linkSiblings(newnd)
-
-		// insert siblings into parent of leaf
-		if n.parent == nil {
-			// new parent for both siblings
-			n.parent = new(node)
-			newnd.parent = n.parent
-			// set parent level to 1
-			n.parent.level = (n.level + 1)
-			// set next,prev of parent to itself
-			n.parent.next = n.parent
-			n.parent.prev= n.parent
-			// insert siblings into parent
-			newroot = n.parent.insertDir(n, newnd, maxk)
-		} else {
-			newnd.parent = n.parent
-			// insert siblings into parent
-			newroot = n.parent.insertDir(n, newnd, maxk)
+// insert into subtree of owned node n
+// returns separator and new right sibling if n split
+// and whether key was added rather than replaced
+func (tree *Bptree) insert(n *node, key Item, value string) (Item, *node, bool) {
+	var added bool
+	if n.leaf {
+		added = n.insertInLeaf(key, value)
+	} else {
+		i := n.childIdx(key)
+		c := tree.ownChild(n, i)
+		var sep Item
+		var rchld *node
+		sep, rchld, added = tree.insert(c, key, value)
+		if rchld != nil {
+			n.insertDir(i, sep, rchld)
 		}
 	}
-	if newroot != nil {
-		if newroot.parent == nil {
-			return newroot
-		}
+	if len(n.keys) > tree.degree {
+		sep, nn := n.split()
+		nn.owner = tree.owner
+		return sep, nn, added
 	}
-	return root
+	return 0, nil, added
 }
 
 // split a node (leaf or internal)
-func (n *node) split() *node {
+// returns separator key and new right node
+func (n *node) split() (Item, *node) {
 	nn := new(node)
 	p := len(n.keys)/2
 	nn.level = n.level
@@ -608,29 +465,22 @@ func (n *node) split() *node {
 		copy(nvs, n.vals[:p])
 		n.vals = nvs
 		nn.leaf = true
-	} else {
-		// distribute children
-		q := len(n.children)/2
-		nn.children = make([]*node, len(n.children[q:]))
-		copy(nn.children, n.children[q:])
-		ncs := make([]*node, q)
-		copy(ncs, n.children[:q])
-		n.children = ncs
-		// distribute keys
-		nn.keys = make([]Item, len(n.keys[p:])-1)
-		copy(nn.keys, n.keys[p+1:])
-		nks := make([]Item, p)
-		copy(nks, n.keys[:p])
-		n.keys = nks
-		// update parent links
-		for i:=0; i < len(nn.children); i++ {
-			nn.children[i].parent = nn
-		}
-		for i:=0; i < len(n.children); i++ {
-			n.children[i].parent = n
-		}
-	}
-	return nn
+		return nn.keys[0], nn
+	}
+	// key p moves up, children right of it go to nn
+	sep := n.keys[p]
+	nn.children = make([]*node, len(n.children[p+1:]))
+	copy(nn.children, n.children[p+1:])
+	ncs := make([]*node, p+1)
+	copy(ncs, n.children[:p+1])
+	n.children = ncs
+	// distribute keys
+	nn.keys = make([]Item, len(n.keys[p+1:]))
+	copy(nn.keys, n.keys[p+1:])
+	nks := make([]Item, p)
+	copy(nks, n.keys[:p])
+	n.keys = nks
+	return sep, nn
 }
 
 // print Item
@@ -639,9 +489,9 @@ func (a Item) Print(w io.Writer) {
 }
 
 // print the tree BFS nodes
-func (n *node) printnode(w io.Writer) {
+func (n *node) printnode(w io.Writer, root bool) {
 	if !n.leaf {
-		if n.parent == nil {
+		if root {
 			fmt.Fprintf(w, "\nl%d:", n.level)
 			fmt.Fprintln(w, n.keys)
 			fmt.Fprintf(w, "\nl%d:", n.level-1)
@@ -659,7 +509,7 @@ func (n *node) printnode(w io.Writer) {
 			}
 		}
 		for i:=0; i < len(n.children); i++ {
-			n.children[i].printnode(w)
+			n.children[i].printnode(w, false)
 		}
 		return
 	} else {
@@ -681,22 +531,45 @@ func New(degree int) (*Bptree, error) {
 	if degree < 3 {
 		return nil, errors.New("Minimum degree 3")
 	}
-	return &Bptree{degree: degree}, nil
+	return &Bptree{degree: degree, owner: new(owner)}, nil
+}
+
+// O(1) snapshot sharing all nodes with tree
+// later writes to either tree copy the nodes they touch,
+// so neither sees the other's writes
+// must be called by the writer of tree
+func (tree *Bptree) Clone() *Bptree {
+	// shared nodes now belong to neither tree
+	tree.owner = new(owner)
+	return &Bptree{degree: tree.degree, length: tree.length, root: tree.root, owner: new(owner)}
+}
+
+// number of keys in tree
+func (tree *Bptree) Len() int {
+	return tree.length
 }
 
 // insert into tree
 func (tree *Bptree) Insert(key Item, value string) Item {
 	//fmt.Println("Inserting", key, value)
 	if tree.root == nil {
-		tree.root = new(node)
-		tree.root.leaf = true
+		tree.root = &node{leaf: true, owner: tree.owner}
 		tree.root.keys = append(tree.root.keys, key)
 		tree.root.vals = append(tree.root.vals, value)
-		tree.root.next = tree.root
-		tree.root.prev = tree.root
 		tree.length++
-	} else {
-		tree.root = tree.root.insert(key, value, nil, nil, tree.degree)
+		return key
+	}
+	tree.root = tree.own(tree.root)
+	sep, rchld, added := tree.insert(tree.root, key, value)
+	if rchld != nil {
+		// root split, new root one level up
+		nr := &node{level: tree.root.level+1, owner: tree.owner}
+		nr.keys = items{sep}
+		nr.children = children{tree.root, rchld}
+		tree.root = nr
+	}
+	if added {
+		tree.length++
 	}
 	//tree.Print()
 	return key
@@ -707,10 +580,21 @@ func (tree *Bptree) Del(key Item) (bool, string) {
 	if tree.root == nil {
 		return false, ""
 	}
-	var b bool
-	var s string
-	b, s, tree.root = tree.root.del(key, tree.degree)
-	return b, s
+	// absent key: leave shared nodes alone
+	if _, found := tree.root.get(key); !found {
+		return false, ""
+	}
+	tree.root = tree.own(tree.root)
+	found, retval := tree.del(tree.root, key)
+	if !tree.root.leaf && len(tree.root.keys) == 0 {
+		// root lost its last separator, one level down
+		tree.root = tree.root.children[0]
+	}
+	if tree.root.leaf && len(tree.root.keys) == 0 {
+		tree.root = nil
+	}
+	tree.length--
+	return found, retval
 }
 
 // get value at key
@@ -718,15 +602,69 @@ func (tree *Bptree) Get(key Item) string {
 	if tree.root == nil {
 		return ""
 	}
-	return tree.root.get(key)
+	val, _ := tree.root.get(key)
+	return val
 }
 
 // get N node values at nodes greater than key
+// wraps around past the max key
 func (tree *Bptree) GetNextN (key Item, N int) []string {
 	if tree.root == nil {
 		return nil
 	}
-	return tree.root.getNextN(key, N)
+	var nextN []string
+	c := tree.root.seek(key)
+	for i:=0; i<N; i++ {
+		_, v := c.item()
+		nextN = append(nextN, v)
+		c.next()
+	}
+	return nextN
+}
+
+// walk key,value pairs clockwise from next larger key
+// each pair visited once, stop when fn returns false
+func (tree *Bptree) Walk(key Item, fn func(Item, string) bool) {
+	if tree.root == nil {
+		return
+	}
+	c := tree.root.seek(key)
+	for i:=0; i < tree.length; i++ {
+		if !fn(c.item()) {
+			return
+		}
+		c.next()
+	}
+}
+
+// walk key,value pairs counter-clockwise from largest key <= key
+// each pair visited once, stop when fn returns false
+func (tree *Bptree) WalkBack(key Item, fn func(Item, string) bool) {
+	if tree.root == nil {
+		return
+	}
+	c := tree.root.seek(key)
+	for i:=0; i < tree.length; i++ {
+		c.prev()
+		if !fn(c.item()) {
+			return
+		}
+	}
+}
+
+// walk key,value pairs in key order from min key
+// stop when fn returns false
+func (tree *Bptree) Ascend(fn func(Item, string) bool) {
+	if tree.root == nil {
+		return
+	}
+	c := tree.root.first()
+	for i:=0; i < tree.length; i++ {
+		if !fn(c.item()) {
+			return
+		}
+		c.next()
+	}
 }
 
 // print the whole tree
@@ -737,7 +675,7 @@ func (tree *Bptree) Print(w io.Writer) {
 	}
 	fmt.Fprintln(w, "Min:", tree.root.minKey())
 	fmt.Fprintln(w, "Max:", tree.root.maxKey())
-	tree.root.printnode(w)
+	tree.root.printnode(w, true)
 	fmt.Fprintln(w)
 }
 
@@ -0,0 +1,218 @@
+package bptree
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// tree with the map it must agree with
+type checked struct {
+	tree *Bptree
+	ref  map[Item]string
+}
+
+func (c *checked) insert(k Item, v string) {
+	c.tree.Insert(k, v)
+	c.ref[k] = v
+}
+
+func (c *checked) del(t *testing.T, k Item) {
+	t.Helper()
+	want, ok := c.ref[k]
+	found, got := c.tree.Del(k)
+	if found != ok || got != want {
+		t.Fatalf("Del(%d): %t %q, want %t %q", k, found, got, ok, want)
+	}
+	delete(c.ref, k)
+}
+
+func (c *checked) clone() *checked {
+	ref := make(map[Item]string, len(c.ref))
+	for k, v := range c.ref {
+		ref[k] = v
+	}
+	return &checked{tree: c.tree.Clone(), ref: ref}
+}
+
+// ref keys in order
+func (c *checked) keys() []Item {
+	keys := make([]Item, 0, len(c.ref))
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// compare every read API with the reference
+func (c *checked) verify(t *testing.T, space int) {
+	t.Helper()
+	keys := c.keys()
+	if c.tree.Len() != len(keys) {
+		t.Fatalf("Len: %d, want %d", c.tree.Len(), len(keys))
+	}
+	i := 0
+	c.tree.Ascend(func(k Item, v string) bool {
+		if i >= len(keys) || k != keys[i] || v != c.ref[k] {
+			t.Fatalf("Ascend %d: %d %q", i, k, v)
+		}
+		i++
+		return true
+	})
+	if i != len(keys) {
+		t.Fatalf("Ascend visited %d of %d", i, len(keys))
+	}
+	for k := Item(0); k < Item(space); k++ {
+		if got := c.tree.Get(k); got != c.ref[k] {
+			t.Fatalf("Get(%d): %q, want %q", k, got, c.ref[k])
+		}
+	}
+	if len(keys) == 0 {
+		c.tree.Walk(0, func(Item, string) bool { t.Fatalf("Walk on empty tree"); return false })
+		c.tree.WalkBack(0, func(Item, string) bool { t.Fatalf("WalkBack on empty tree"); return false })
+		if got := c.tree.GetNextN(0, 2); got != nil {
+			t.Fatalf("GetNextN on empty tree: %q", got)
+		}
+		return
+	}
+	for _, from := range []Item{0, keys[0], keys[len(keys)/2], keys[len(keys)-1], Item(space / 2), Item(space)} {
+		// first key after from, wrapping around
+		start := sort.Search(len(keys), func(i int) bool { return keys[i] > from }) % len(keys)
+		i := 0
+		c.tree.Walk(from, func(k Item, v string) bool {
+			if want := keys[(start+i)%len(keys)]; k != want || v != c.ref[want] {
+				t.Fatalf("Walk(%d) step %d: %d, want %d", from, i, k, want)
+			}
+			i++
+			return true
+		})
+		if i != len(keys) {
+			t.Fatalf("Walk(%d) visited %d of %d", from, i, len(keys))
+		}
+		// largest key <= from, wrapping around
+		back := start - 1 + len(keys)
+		i = 0
+		c.tree.WalkBack(from, func(k Item, v string) bool {
+			if want := keys[(back-i)%len(keys)]; k != want || v != c.ref[want] {
+				t.Fatalf("WalkBack(%d) step %d: %d, want %d", from, i, k, want)
+			}
+			i++
+			return true
+		})
+		if i != len(keys) {
+			t.Fatalf("WalkBack(%d) visited %d of %d", from, i, len(keys))
+		}
+		n := len(keys) + 2
+		got := c.tree.GetNextN(from, n)
+		for i := 0; i < n; i++ {
+			if want := c.ref[keys[(start+i)%len(keys)]]; got[i] != want {
+				t.Fatalf("GetNextN(%d, %d)[%d]: %q, want %q", from, n, i, got[i], want)
+			}
+		}
+		stops := 0
+		c.tree.Walk(from, func(Item, string) bool { stops++; return false })
+		if stops != 1 {
+			t.Fatalf("Walk(%d) went on after false", from)
+		}
+	}
+}
+
+func newChecked(t *testing.T, degree int) *checked {
+	t.Helper()
+	tree, err := New(degree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &checked{tree: tree, ref: make(map[Item]string)}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(2); err == nil {
+		t.Errorf("degree 2 accepted")
+	}
+}
+
+func TestAgainstMap(t *testing.T) {
+	for _, degree := range []int{3, 4, 5, 8} {
+		t.Run(strconv.Itoa(degree), func(t *testing.T) {
+			const space = 300
+			rnd := rand.New(rand.NewSource(int64(degree)))
+			c := newChecked(t, degree)
+			for step := 0; step < 3000; step++ {
+				k := Item(rnd.Intn(space))
+				// grow for the first half, then shrink to empty
+				if rnd.Intn(3000) > step {
+					c.insert(k, "v"+strconv.Itoa(step))
+				} else {
+					c.del(t, k)
+				}
+				if step%50 == 0 {
+					c.verify(t, space)
+				}
+			}
+			for _, k := range c.keys() {
+				c.del(t, k)
+			}
+			c.verify(t, space)
+		})
+	}
+}
+
+// writes to a tree or its clones are seen by that tree only
+func TestClone(t *testing.T) {
+	for _, degree := range []int{3, 4, 7} {
+		t.Run(strconv.Itoa(degree), func(t *testing.T) {
+			const space = 200
+			rnd := rand.New(rand.NewSource(int64(degree)))
+			trees := []*checked{newChecked(t, degree)}
+			for i := 0; i < 150; i++ {
+				trees[0].insert(Item(rnd.Intn(space)), "base"+strconv.Itoa(i))
+			}
+			for step := 0; step < 4000; step++ {
+				c := trees[rnd.Intn(len(trees))]
+				switch r := rnd.Intn(20); {
+				case r == 0 && len(trees) < 12:
+					trees = append(trees, c.clone())
+				case r < 11:
+					c.insert(Item(rnd.Intn(space)), "s"+strconv.Itoa(step))
+				default:
+					c.del(t, Item(rnd.Intn(space)))
+				}
+				if step%100 == 0 {
+					for _, c := range trees {
+						c.verify(t, space)
+					}
+				}
+			}
+			for _, c := range trees {
+				c.verify(t, space)
+			}
+		})
+	}
+}
+
+// a clone taken before writes keeps answering as the tree did
+func TestCloneFrozen(t *testing.T) {
+	c := newChecked(t, 3)
+	for i := 0; i < 64; i++ {
+		c.insert(Item(i*2), "a")
+	}
+	snap := c.clone()
+	for i := 0; i < 64; i++ {
+		if i%3 == 0 {
+			c.del(t, Item(i*2))
+		} else {
+			c.insert(Item(i*2+1), "b")
+		}
+	}
+	snap.verify(t, 200)
+	c.verify(t, 200)
+	// and writes to the clone leave the tree alone
+	for i := 0; i < 128; i++ {
+		snap.insert(Item(i), "c")
+	}
+	snap.verify(t, 200)
+	c.verify(t, 200)
+}
@@ -0,0 +1,157 @@
+// lookup, plan and stats subcommands
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// owners (and replicas) of keys with one POST /locate
+func locateCmd(args []string, replicas bool) error {
+	fs := flag.NewFlagSet("locate", flag.ExitOnError)
+	op := fs.String("op", "read", "read or write")
+	n := 0
+	if replicas {
+		fs.IntVar(&n, "n", 3, "replicas per key")
+	}
+	keys := parseArgs(fs, args)
+	if len(keys) == 0 {
+		return fmt.Errorf("keys needed")
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	q := url.Values{"op": {*op}}
+	if n > 0 {
+		q.Set("replicas", strconv.Itoa(n))
+	}
+	body, _, err := post(ringURL("/locate?"+q.Encode()), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	var out struct {
+		Epoch uint64 `json:"epoch"`
+		Keys  []struct {
+			Key      string   `json:"key"`
+			Node     string   `json:"node"`
+			Replicas []string `json:"replicas,omitempty"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	if output == "json" {
+		return emit(out)
+	}
+	var rows [][]string
+	for _, k := range out.Keys {
+		if replicas {
+			rows = append(rows, []string{k.Key, strings.Join(k.Replicas, ",")})
+		} else {
+			rows = append(rows, []string{k.Key, k.Node})
+		}
+	}
+	if replicas {
+		table([]string{"KEY", "REPLICAS"}, rows)
+	} else {
+		table([]string{"KEY", "NODE"}, rows)
+	}
+	return nil
+}
+
+// ranges moving on a proposed change
+func planCmd(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	op := fs.String("op", "", "add, remove or weight")
+	node := fs.String("node", "", "node name")
+	weight := fs.Int("weight", 0, "weight for add or weight")
+	region := fs.String("region", "", "region for add")
+	zone := fs.String("zone", "", "zone for add")
+	rack := fs.String("rack", "", "rack for add")
+	parseArgs(fs, args)
+	q := url.Values{"op": {*op}, "node": {*node}}
+	if *weight > 0 {
+		q.Set("weight", strconv.Itoa(*weight))
+	}
+	for k, v := range map[string]string{"region": *region, "zone": *zone, "rack": *rack} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	body, _, err := get(ringURL("/plan?" + q.Encode()))
+	if err != nil {
+		return err
+	}
+	ls := lines(body)
+	if len(ls) > 0 && strings.HasPrefix(ls[0], "moved:") {
+		// maglev: entry count only
+		return report(ls, []string{"moved", "fraction"})
+	}
+	if len(ls) > 0 && !failed(ls[0]) && output == "table" {
+		// moves, then the total
+		if err := report(ls[:len(ls)-1], []string{"range", "from", "to", "fraction"}); err != nil {
+			return err
+		}
+		fmt.Println(ls[len(ls)-1])
+		return nil
+	}
+	return report(ls, []string{"range", "from", "to", "fraction"})
+}
+
+// balance stats
+func statsCmd(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	samples := fs.Int("samples", -1, "synthetic keys to route, server default if negative")
+	parseArgs(fs, args)
+	u := ringURL("/stats")
+	if *samples >= 0 {
+		u += "?samples=" + strconv.Itoa(*samples)
+	}
+	body, _, err := get(u)
+	if err != nil {
+		return err
+	}
+	ls := lines(body)
+	if len(ls) > 0 && failed(ls[0]) {
+		return fmt.Errorf("%s", ls[0])
+	}
+	if output == "table" {
+		for _, l := range ls {
+			fmt.Println(l)
+		}
+		return nil
+	}
+	// ring line, then per section a title, node shares and a summary
+	type section struct {
+		Title   string             `json:"title"`
+		Shares  map[string]float64 `json:"shares"`
+		Summary map[string]string  `json:"summary"`
+	}
+	var out struct {
+		Ring     map[string]string `json:"ring"`
+		Sections []*section        `json:"sections"`
+	}
+	var cur *section
+	for i, l := range ls {
+		switch {
+		case i == 0:
+			out.Ring = fields(l)
+		case strings.HasSuffix(l, ":"):
+			cur = &section{Title: strings.TrimSuffix(l, ":"), Shares: make(map[string]float64)}
+			out.Sections = append(out.Sections, cur)
+		case cur != nil && strings.HasPrefix(l, "node:"):
+			f := fields(l)
+			cur.Shares[f["node"]], _ = strconv.ParseFloat(f["share"], 64)
+		case cur != nil:
+			cur.Summary = fields(l)
+		}
+	}
+	return emit(out)
+}
@@ -0,0 +1,284 @@
+// chrctl: command line client for cons_hring
+// server from -server or CHR_SERVER, ring from -ring or CHR_RING,
+// output as a table or as JSON with -o json
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"ring"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `usage: chrctl [-server url] [-ring name] [-o table|json] command
+
+commands:
+  ring create [-algorithm bptree|multiprobe|maglev] [-table n] [-probes k]
+  ring list
+  ring delete
+  node list
+  node add [-weight w] [-state joining|active] [-region r] [-zone z] [-rack r]
+           [-addr host:port] [-check tcp|http] [-path p] [-status s] name
+  node remove name
+  node drain name
+  node weight name w
+  locate [-op read|write] key...
+  replicas [-n 3] [-op read|write] key...
+  plan -op add|remove|weight -node name [-weight w] [-zone z] [-rack r]
+  stats [-samples n]
+  snapshot save [-binary] file
+  snapshot restore file
+  watch [-since epoch]
+`
+
+var (
+	server   = envOr("CHR_SERVER", "http://localhost:8080")
+	ringName = os.Getenv("CHR_RING")
+	output   = "table"
+)
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func main() {
+	flag.StringVar(&server, "server", server, "server address (CHR_SERVER)")
+	flag.StringVar(&ringName, "ring", ringName, "ring name, default ring if empty (CHR_RING)")
+	flag.StringVar(&output, "o", output, "output: table or json")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if output != "table" && output != "json" {
+		fail(fmt.Errorf("unknown output %s", output))
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	switch args[0] {
+	case "ring":
+		err = ringCmd(args[1:])
+	case "node":
+		err = nodeCmd(args[1:])
+	case "locate":
+		err = locateCmd(args[1:], false)
+	case "replicas":
+		err = locateCmd(args[1:], true)
+	case "plan":
+		err = planCmd(args[1:])
+	case "stats":
+		err = statsCmd(args[1:])
+	case "snapshot":
+		err = snapshotCmd(args[1:])
+	case "watch":
+		err = watchCmd(args[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "chrctl: %s\n", err)
+	os.Exit(1)
+}
+
+// parse flags of a subcommand, which may follow its arguments
+// returns the arguments
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var pos []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return pos
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+}
+
+// URL of path on the selected ring
+func ringURL(path string) string {
+	base := strings.TrimRight(server, "/")
+	if ringName != "" {
+		base += "/rings/" + ringName
+	}
+	return base + path
+}
+
+// send request, body and epoch of a 200 response
+func do(req *http.Request) ([]byte, uint64, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	epoch, _ := strconv.ParseUint(resp.Header.Get("X-Ring-Epoch"), 10, 64)
+	return body, epoch, nil
+}
+
+func get(url string) ([]byte, uint64, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return do(req)
+}
+
+func post(url, contentType string, body io.Reader) ([]byte, uint64, error) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return do(req)
+}
+
+// text body without the trailing epoch line
+func lines(body []byte) []string {
+	var out []string
+	for _, l := range strings.Split(strings.TrimRight(string(body), "\n"), "\n") {
+		if l != "" && !strings.HasPrefix(l, "epoch:") {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// server messages that report a failure with status 200,
+// the errors of the handlers and of the ring package
+var failures = []string{
+	"Ring not created", "Ring empty", "Invalid", "Unknown", "Unsupported", "Not supported",
+	"Health check", "Stale epoch", "Future epoch", "Replay epoch", "No ring",
+	"Probes must", "Table size must", "All nodes at capacity",
+	"Empty batch", "Batch too large", "Too many keys", "Bad snapshot", "Snapshot does not match",
+	"op ", // batch op that failed, by index
+}
+
+func failed(l string) bool {
+	for _, f := range failures {
+		if strings.HasPrefix(l, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// key:value fields of a server line, separated by commas or spaces
+// outside brackets, so ranges like [a,b) stay whole
+func fields(l string) map[string]string {
+	m := make(map[string]string)
+	depth := 0
+	sep := func(r rune) bool {
+		switch r {
+		case '[':
+			depth++
+		case ')', ']':
+			depth--
+		case ',', ' ':
+			return depth == 0
+		}
+		return false
+	}
+	for _, f := range strings.FieldsFunc(l, sep) {
+		if i := strings.IndexByte(f, ':'); i > 0 {
+			m[f[:i]] = f[i+1:]
+		}
+	}
+	return m
+}
+
+// print outcome of a change: server message, or JSON with the epoch
+func result(body []byte, epoch uint64) error {
+	ls := lines(body)
+	if len(ls) > 0 && failed(ls[0]) {
+		return fmt.Errorf("%s", ls[0])
+	}
+	if output == "json" {
+		return emit(struct {
+			Result string `json:"result"`
+			Epoch  uint64 `json:"epoch"`
+		}{strings.Join(ls, "\n"), epoch})
+	}
+	for _, l := range ls {
+		fmt.Println(l)
+	}
+	return nil
+}
+
+func emit(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func table(header []string, rows [][]string) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, r := range rows {
+		fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+	tw.Flush()
+}
+
+// text lines as a table of their key:value fields, or as JSON objects
+func report(ls []string, keys []string) error {
+	if len(ls) > 0 && failed(ls[0]) {
+		return fmt.Errorf("%s", ls[0])
+	}
+	var objs []map[string]string
+	var rows [][]string
+	for _, l := range ls {
+		f := fields(l)
+		objs = append(objs, f)
+		row := make([]string, len(keys))
+		for i, k := range keys {
+			row[i] = f[k]
+		}
+		rows = append(rows, row)
+	}
+	if output == "json" {
+		return emit(objs)
+	}
+	header := make([]string, len(keys))
+	for i, k := range keys {
+		header[i] = strings.ToUpper(k)
+	}
+	table(header, rows)
+	return nil
+}
+
+// snapshot of the selected ring
+func fetchSnapshot() (*ring.Snapshot, error) {
+	body, _, err := get(ringURL("/snapshot"))
+	if err != nil {
+		return nil, err
+	}
+	var s ring.Snapshot
+	if err := json.Unmarshal(body, &s); err != nil {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	return &s, nil
+}
@@ -0,0 +1,165 @@
+// ring and node subcommands
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"ring"
+	"strconv"
+	"strings"
+)
+
+func ringCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("ring: create, list or delete")
+	}
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("ring create", flag.ExitOnError)
+		algo := fs.String("algorithm", ring.AlgoBptree, "bptree, multiprobe or maglev")
+		table := fs.Int("table", 0, "maglev table size, prime")
+		probes := fs.Int("probes", 0, "multiprobe probe count")
+		parseArgs(fs, args[1:])
+		q := url.Values{"algorithm": {*algo}}
+		if *table > 0 {
+			q.Set("table", strconv.Itoa(*table))
+		}
+		if *probes > 0 {
+			q.Set("probes", strconv.Itoa(*probes))
+		}
+		body, epoch, err := get(ringURL("/creat?" + q.Encode()))
+		if err != nil {
+			return err
+		}
+		return result(body, epoch)
+	case "list":
+		body, _, err := get(strings.TrimRight(server, "/") + "/rings")
+		if err != nil {
+			return err
+		}
+		return report(lines(body), []string{"ring", "algorithm", "epoch", "nodes"})
+	case "delete":
+		if ringName == "" {
+			return fmt.Errorf("ring delete: -ring name needed")
+		}
+		req, err := http.NewRequest(http.MethodDelete, ringURL(""), nil)
+		if err != nil {
+			return err
+		}
+		body, _, err := do(req)
+		if err != nil {
+			return err
+		}
+		return result(body, 0)
+	}
+	return fmt.Errorf("ring: unknown command %s", args[0])
+}
+
+func nodeCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("node: list, add, remove, drain or weight")
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list":
+		return nodeList()
+	case "add":
+		return nodeAdd(args)
+	case "remove":
+		if len(args) != 1 {
+			return fmt.Errorf("node remove: name needed")
+		}
+		body, epoch, err := get(ringURL("/del/" + args[0]))
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(lines(body)[0], ",val:") || strings.Contains(lines(body)[0], ":false") {
+			return fmt.Errorf("Unknown node %s", args[0])
+		}
+		return result(body, epoch)
+	case "drain":
+		if len(args) != 1 {
+			return fmt.Errorf("node drain: name needed")
+		}
+		body, epoch, err := get(ringURL("/nodes/" + args[0] + "/state?state=" + ring.StateDraining))
+		if err != nil {
+			return err
+		}
+		return result(body, epoch)
+	case "weight":
+		if len(args) != 2 {
+			return fmt.Errorf("node weight: name and weight needed")
+		}
+		w, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("node weight: invalid weight %s", args[1])
+		}
+		return batch([]ring.Op{{Op: "weight", Node: args[0], Weight: w}})
+	}
+	return fmt.Errorf("node: unknown command %s", cmd)
+}
+
+func nodeAdd(args []string) error {
+	fs := flag.NewFlagSet("node add", flag.ExitOnError)
+	weight := fs.Int("weight", 0, "points on the ring")
+	params := []string{"state", "region", "zone", "rack", "addr", "check", "path", "status"}
+	vals := make(map[string]*string)
+	for _, p := range params {
+		vals[p] = fs.String(p, "", p)
+	}
+	pos := parseArgs(fs, args)
+	if len(pos) != 1 {
+		return fmt.Errorf("node add: name needed")
+	}
+	q := url.Values{}
+	if *weight > 0 {
+		q.Set("weight", strconv.Itoa(*weight))
+	}
+	for _, p := range params {
+		if *vals[p] != "" {
+			q.Set(p, *vals[p])
+		}
+	}
+	body, epoch, err := get(ringURL("/add/" + pos[0] + "?" + q.Encode()))
+	if err != nil {
+		return err
+	}
+	return result(body, epoch)
+}
+
+// apply ops with one POST /batch
+func batch(ops []ring.Op) error {
+	data, err := json.Marshal(struct {
+		Ops []ring.Op `json:"ops"`
+	}{ops})
+	if err != nil {
+		return err
+	}
+	body, epoch, err := post(ringURL("/batch"), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return result(body, epoch)
+}
+
+// nodes from the snapshot
+func nodeList() error {
+	s, err := fetchSnapshot()
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return emit(s.Nodes)
+	}
+	var rows [][]string
+	for _, n := range s.Nodes {
+		rows = append(rows, []string{n.Name, strconv.Itoa(n.Weight), n.State, n.Region, n.Zone, n.Rack, n.Addr})
+	}
+	table([]string{"NODE", "WEIGHT", "STATE", "REGION", "ZONE", "RACK", "ADDR"}, rows)
+	return nil
+}
@@ -0,0 +1,160 @@
+// snapshot and watch subcommands
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"ring"
+	"strconv"
+	"strings"
+)
+
+func snapshotCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("snapshot: save or restore")
+	}
+	switch args[0] {
+	case "save":
+		fs := flag.NewFlagSet("snapshot save", flag.ExitOnError)
+		bin := fs.Bool("binary", false, "binary encoding instead of JSON")
+		pos := parseArgs(fs, args[1:])
+		if len(pos) != 1 {
+			return fmt.Errorf("snapshot save: file needed")
+		}
+		return snapshotSave(pos[0], *bin)
+	case "restore":
+		if len(args) != 2 {
+			return fmt.Errorf("snapshot restore: file needed")
+		}
+		return snapshotRestore(args[1])
+	}
+	return fmt.Errorf("snapshot: unknown command %s", args[0])
+}
+
+func snapshotSave(file string, bin bool) error {
+	req, err := http.NewRequest(http.MethodGet, ringURL("/snapshot"), nil)
+	if err != nil {
+		return err
+	}
+	if bin {
+		req.Header.Set("Accept", ring.SnapshotBinary)
+	}
+	body, epoch, err := do(req)
+	if err != nil {
+		return err
+	}
+	if ls := lines(body); len(ls) > 0 && failed(ls[0]) {
+		return fmt.Errorf("%s", ls[0])
+	}
+	if err := os.WriteFile(file, body, 0644); err != nil {
+		return err
+	}
+	if output == "json" {
+		return emit(struct {
+			File  string `json:"file"`
+			Epoch uint64 `json:"epoch"`
+			Bytes int    `json:"bytes"`
+		}{file, epoch, len(body)})
+	}
+	fmt.Printf("saved epoch %d to %s (%d bytes)\n", epoch, file, len(body))
+	return nil
+}
+
+// re-create the ring from a saved snapshot: create with its
+// algorithm, then add its nodes in one batch
+// the batch is checked on a local ring first, so a snapshot the
+// server would refuse does not leave the ring re-created empty
+// the restored ring continues from the server's epoch
+func snapshotRestore(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var s *ring.Snapshot
+	if bytes.HasPrefix(data, []byte("CHRS")) {
+		s, err = ring.Decode(data)
+	} else {
+		s = new(ring.Snapshot)
+		err = json.Unmarshal(data, s)
+	}
+	if err != nil {
+		return err
+	}
+	ops := s.Ops()
+	local, err := ring.New(ring.Options{Algorithm: s.Algorithm, Table: s.Table, Probes: s.Probes})
+	if err != nil {
+		return err
+	}
+	if len(ops) > 0 {
+		if _, err := local.Apply(append([]ring.Op(nil), ops...)); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+	}
+	q := url.Values{"algorithm": {s.Algorithm}}
+	if s.Table > 0 {
+		q.Set("table", strconv.Itoa(s.Table))
+	}
+	if s.Probes > 0 {
+		q.Set("probes", strconv.Itoa(s.Probes))
+	}
+	body, _, err := get(ringURL("/creat?" + q.Encode()))
+	if err != nil {
+		return err
+	}
+	if ls := lines(body); len(ls) > 0 && failed(ls[0]) {
+		return fmt.Errorf("%s", ls[0])
+	}
+	if len(ops) == 0 {
+		return result(body, 0)
+	}
+	return batch(ops)
+}
+
+// stream ring changes until interrupted
+func watchCmd(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	since := fs.Int64("since", -1, "replay changes after epoch, from now if negative")
+	parseArgs(fs, args)
+	u := ringURL("/watch")
+	if *since >= 0 {
+		u += "?since=" + strconv.FormatInt(*since, 10)
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		l := sc.Text()
+		if !strings.HasPrefix(l, "data: ") {
+			continue
+		}
+		data := l[len("data: "):]
+		if output == "json" {
+			fmt.Println(data)
+			continue
+		}
+		var ev ring.Event
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			return err
+		}
+		ops := make([]string, len(ev.Ops))
+		for i, op := range ev.Ops {
+			ops[i] = op.String()
+		}
+		fmt.Printf("epoch:%d %s %s %s\n", ev.Epoch, ev.Kind, ev.Actor, strings.Join(ops, "; "))
+	}
+	return sc.Err()
+}
@@ -0,0 +1,227 @@
+// chrplace: offline placement from a members file
+// builds the ring in process with the server's code, prints
+// placements, per node shares and movement against a second
+// members file; lines match the server's answers (less epoch lines)
+//
+// members file, one node per line, # comments:
+//   name weight [zone [rack [region]]]
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"ring"
+	"strconv"
+	"strings"
+)
+
+var validName = regexp.MustCompile("^[a-zA-Z0-9.]+$")
+
+func main() {
+	members := flag.String("members", "", "members file")
+	keysFile := flag.String("keys", "", "keys file, one per line (- for stdin)")
+	count := flag.Int("count", 0, "synthetic keys key0..keyN-1, as /stats samples (multiprobe default 100000)")
+	diff := flag.String("diff", "", "second members file to compare against")
+	algo := flag.String("algorithm", ring.AlgoBptree, "bptree, multiprobe or maglev")
+	table := flag.Int("table", ring.DefaultTableSize, "maglev table size")
+	probes := flag.Int("probes", ring.DefaultProbes, "multiprobe probes")
+	replicas := flag.Int("replicas", 0, "also print n replicas per key")
+	quiet := flag.Bool("q", false, "no per key lines")
+	flag.Parse()
+	if *members == "" {
+		fmt.Fprintln(os.Stderr, "chrplace: -members needed")
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts := ring.Options{Algorithm: *algo, Table: *table, Probes: *probes}
+	cur, err := load(*members, opts)
+	if err != nil {
+		fail(err)
+	}
+	keys, err := readKeys(*keysFile, *count)
+	if err != nil {
+		fail(err)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	if !*quiet {
+		for _, k := range keys {
+			place(w, cur, k, *replicas)
+		}
+	}
+	// same sample keys as /stats?samples=count, and the same
+	// default for multiprobe rings when -count is not given
+	samples := *count
+	if cur.Algorithm() == ring.AlgoMultiprobe && !flagSet("count") {
+		samples = ring.DefaultSamples
+	}
+	cur.PrintStats(w, samples)
+
+	if *diff == "" {
+		return
+	}
+	next, err := load(*diff, opts)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(w, "plan %s -> %s:\n", *members, *diff)
+	if err := cur.Plan(w, changes(cur, next)); err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+	}
+	if len(keys) > 0 {
+		moved := 0
+		for _, k := range keys {
+			if cur.Locate(k, ring.Read) != next.Locate(k, ring.Read) {
+				moved++
+			}
+		}
+		fmt.Fprintf(w, "moved keys:%d/%d fraction:%.6f\n", moved, len(keys), float64(moved)/float64(len(keys)))
+	}
+}
+
+// flag given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "chrplace: %s\n", err)
+	os.Exit(1)
+}
+
+// /locate/{key} line, and /replicas/{key}?n= line if n > 0
+func place(w io.Writer, r *ring.Ring, key string, n int) {
+	h := ring.HashKey(key)
+	node := r.Locate(key, ring.Read)
+	fmt.Fprintf(w, "key:%x,node:%s,state:%s\n", h, node, r.NodeState(node))
+	if n == 0 {
+		return
+	}
+	nodes, err := r.Replicas(key, n, ring.Read)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	states := make([]string, len(nodes))
+	for i, name := range nodes {
+		states[i] = name + ":" + r.NodeState(name)
+	}
+	fmt.Fprintf(w, "key:%x,replicas:%s\n", h, states)
+}
+
+// ring of a members file
+func load(file string, opts ring.Options) (*ring.Ring, error) {
+	ops, err := readMembers(file)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ring.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) > 0 {
+		if _, err := r.Apply(ops); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+	}
+	return r, nil
+}
+
+// add ops of a members file
+func readMembers(file string) ([]ring.Op, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ops []ring.Op
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fs := strings.Fields(line)
+		if len(fs) == 0 {
+			continue
+		}
+		if len(fs) < 2 || len(fs) > 5 {
+			return nil, fmt.Errorf("%s:%d: want name weight [zone [rack [region]]]", file, n)
+		}
+		if !validName.MatchString(fs[0]) {
+			return nil, fmt.Errorf("%s:%d: invalid node %q", file, n, fs[0])
+		}
+		if seen[fs[0]] {
+			return nil, fmt.Errorf("%s:%d: duplicate node %s", file, n, fs[0])
+		}
+		seen[fs[0]] = true
+		w, err := strconv.Atoi(fs[1])
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("%s:%d: invalid weight %s", file, n, fs[1])
+		}
+		op := ring.Op{Op: "add", Node: fs[0], Weight: w}
+		fs = append(fs, "", "", "")
+		op.Zone, op.Rack, op.Region = fs[2], fs[3], fs[4]
+		ops = append(ops, op)
+	}
+	return ops, sc.Err()
+}
+
+// keys from file, or count synthetic ones
+func readKeys(file string, count int) ([]string, error) {
+	var keys []string
+	if file != "" {
+		in := os.Stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			in = f
+		}
+		sc := bufio.NewScanner(in)
+		for sc.Scan() {
+			if k := strings.TrimSpace(sc.Text()); k != "" {
+				keys = append(keys, k)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < count; i++ {
+		keys = append(keys, "key"+strconv.Itoa(i))
+	}
+	return keys, nil
+}
+
+// ops taking ring cur to the membership of next
+func changes(cur, next *ring.Ring) []ring.Op {
+	var ops []ring.Op
+	for _, n := range cur.Nodes() {
+		if _, ok := next.Node(n.Name); !ok {
+			ops = append(ops, ring.Op{Op: "remove", Node: n.Name})
+		}
+	}
+	for _, n := range next.Nodes() {
+		if old, ok := cur.Node(n.Name); ok && old == n {
+			continue
+		}
+		ops = append(ops, ring.AddOp(n))
+	}
+	return ops
+}
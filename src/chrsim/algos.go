@@ -0,0 +1,125 @@
+// Algorithms under comparison
+// ring, multiprobe and maglev are the ring package's,
+// rendezvous and jump live here
+
+package main
+
+import (
+	"math"
+	"ring"
+	"strconv"
+)
+
+// node of a simulated cluster
+type simNode struct {
+	name   string
+	weight int
+}
+
+// placement algorithm, rebuilt on every membership change
+type placer interface {
+	locate(key string) string
+}
+
+// algorithm by name: build a placer for the membership
+type algorithm struct {
+	name  string
+	build func(nodes []simNode, sc *scenario) (placer, error)
+}
+
+var algorithms = []algorithm{
+	{"ring", buildRing(ring.AlgoBptree)},
+	{"multiprobe", buildRing(ring.AlgoMultiprobe)},
+	{"rendezvous", buildRendezvous},
+	{"jump", buildJump},
+	{"maglev", buildRing(ring.AlgoMaglev)},
+}
+
+// placer of a ring package ring
+type ringPlacer struct {
+	r *ring.Ring
+}
+
+func (p ringPlacer) locate(key string) string {
+	return p.r.Locate(key, ring.Read)
+}
+
+// ring of algo; the bptree ring gets vnodes points per weight unit,
+// multiprobe one point per node, maglev weight entries per round
+func buildRing(algo string) func([]simNode, *scenario) (placer, error) {
+	return func(nodes []simNode, sc *scenario) (placer, error) {
+		r, err := ring.New(ring.Options{Algorithm: algo, Table: sc.Table, Probes: sc.Probes})
+		if err != nil {
+			return nil, err
+		}
+		ops := make([]ring.Op, len(nodes))
+		for i, n := range nodes {
+			w := n.weight
+			if algo == ring.AlgoBptree {
+				w *= sc.Vnodes
+			}
+			ops[i] = ring.Op{Op: "add", Node: n.name, Weight: w}
+		}
+		if len(ops) > 0 {
+			if _, err := r.Apply(ops); err != nil {
+				return nil, err
+			}
+		}
+		return ringPlacer{r}, nil
+	}
+}
+
+// weighted rendezvous (highest random weight) hashing
+// score of a node is -w / ln(u), u uniform in (0,1) from md5(node, key)
+type rendezvous []simNode
+
+func buildRendezvous(nodes []simNode, _ *scenario) (placer, error) {
+	return rendezvous(append([]simNode(nil), nodes...)), nil
+}
+
+func (rv rendezvous) locate(key string) string {
+	best := ""
+	bestScore := math.Inf(-1)
+	for _, n := range rv {
+		u := (float64(ring.HashKey(n.name+"/"+key)>>11) + 0.5) / (1 << 53)
+		if s := -float64(n.weight) / math.Log(u); s > bestScore {
+			best, bestScore = n.name, s
+		}
+	}
+	return best
+}
+
+// jump consistent hash (Lamping & Veach, 2014)
+// buckets are the nodes in membership order, weights ignored;
+// removing any but the last node renumbers the ones after it
+type jump []string
+
+func buildJump(nodes []simNode, _ *scenario) (placer, error) {
+	j := make(jump, len(nodes))
+	for i, n := range nodes {
+		j[i] = n.name
+	}
+	return j, nil
+}
+
+func (j jump) locate(key string) string {
+	if len(j) == 0 {
+		return ""
+	}
+	return j[jumpHash(ring.HashKey(key), len(j))]
+}
+
+func jumpHash(key uint64, buckets int) int {
+	var b, i int64 = -1, 0
+	for i < int64(buckets) {
+		b = i
+		key = key*2862933555777941757 + 1
+		i = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// synthetic key i, as the server's /stats samples
+func simKey(i int) string {
+	return "key" + strconv.Itoa(i)
+}
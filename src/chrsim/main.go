@@ -0,0 +1,381 @@
+// chrsim: consistent hashing algorithm comparison
+// runs cluster scenarios (nodes, weights, vnodes, churn) through
+// ring, multiprobe, rendezvous, jump and maglev and reports balance,
+// keys moved per change, memory and lookup latency as CSV and a
+// markdown summary
+//
+// scenarios file, a JSON array:
+//   [{"name":"small","nodes":10,"weights":[1,2],"vnodes":100,
+//     "keys":100000,"churn":["add n10","remove n3","weight n2 3"]}]
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// one cluster scenario
+type scenario struct {
+	Name    string   `json:"name"`
+	Nodes   int      `json:"nodes"`   // n0..n{N-1}
+	Weights []int    `json:"weights"` // cycled over nodes, 1 if empty
+	Vnodes  int      `json:"vnodes"`  // ring points per weight unit
+	Keys    int      `json:"keys"`
+	Table   int      `json:"table"`  // maglev table size
+	Probes  int      `json:"probes"` // multiprobe probes
+	Churn   []string `json:"churn"`  // add name [w], remove name, weight name w
+}
+
+// measurements of one algorithm after one step
+type result struct {
+	scenario string
+	algo     string
+	step     int
+	change   string
+	nodes    int
+	peak     float64 // peak to expected keys per node, by weight
+	moved    float64 // fraction of keys moved by the change
+	memory   int64   // heap bytes of the built structure
+	lookupNs float64
+}
+
+func main() {
+	file := flag.String("scenarios", "", "scenarios file, JSON array")
+	nodes := flag.Int("nodes", 10, "nodes, without -scenarios")
+	weights := flag.String("weights", "", "comma separated weights, cycled over nodes")
+	vnodes := flag.Int("vnodes", 100, "ring points per weight unit")
+	keys := flag.Int("keys", 100000, "keys routed per step")
+	churn := flag.String("churn", "add n10;remove n3", "changes separated by ;")
+	csvOut := flag.String("csv", "", "write CSV rows to file, - for stdout")
+	mdOut := flag.String("md", "-", "write markdown summary to file, - for stdout")
+	flag.Parse()
+
+	var scs []scenario
+	if *file != "" {
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			fail(err)
+		}
+		if err := json.Unmarshal(data, &scs); err != nil {
+			fail(fmt.Errorf("%s: %s", *file, err))
+		}
+	} else {
+		sc := scenario{Name: "default", Nodes: *nodes, Vnodes: *vnodes, Keys: *keys}
+		for _, w := range strings.Split(*weights, ",") {
+			if w = strings.TrimSpace(w); w != "" {
+				v, err := strconv.Atoi(w)
+				if err != nil {
+					fail(fmt.Errorf("invalid weight %s", w))
+				}
+				sc.Weights = append(sc.Weights, v)
+			}
+		}
+		for _, c := range strings.Split(*churn, ";") {
+			if c = strings.TrimSpace(c); c != "" {
+				sc.Churn = append(sc.Churn, c)
+			}
+		}
+		scs = append(scs, sc)
+	}
+
+	var results []result
+	for i := range scs {
+		rs, err := simulate(&scs[i])
+		if err != nil {
+			fail(fmt.Errorf("scenario %s: %s", scs[i].Name, err))
+		}
+		results = append(results, rs...)
+	}
+	if *csvOut != "" {
+		if err := output(*csvOut, func(w io.Writer) error { return writeCSV(w, results) }); err != nil {
+			fail(err)
+		}
+	}
+	if *mdOut != "" {
+		if err := output(*mdOut, func(w io.Writer) error { return writeMarkdown(w, scs, results) }); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "chrsim: %s\n", err)
+	os.Exit(1)
+}
+
+// write to file, stdout for -
+func output(file string, fn func(io.Writer) error) error {
+	if file == "-" {
+		return fn(os.Stdout)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fill defaults, initial membership
+func (sc *scenario) init() ([]simNode, error) {
+	if sc.Name == "" {
+		sc.Name = "unnamed"
+	}
+	if sc.Nodes < 1 {
+		return nil, fmt.Errorf("nodes must be positive")
+	}
+	if sc.Vnodes < 1 {
+		sc.Vnodes = 100
+	}
+	if sc.Keys < 1 {
+		sc.Keys = 100000
+	}
+	if sc.Table == 0 {
+		sc.Table = 65537
+	}
+	if sc.Probes == 0 {
+		sc.Probes = 21
+	}
+	nodes := make([]simNode, sc.Nodes)
+	for i := range nodes {
+		w := 1
+		if len(sc.Weights) > 0 {
+			w = sc.Weights[i%len(sc.Weights)]
+		}
+		if w < 1 {
+			return nil, fmt.Errorf("invalid weight %d", w)
+		}
+		nodes[i] = simNode{"n" + strconv.Itoa(i), w}
+	}
+	return nodes, nil
+}
+
+// membership after change c, order kept
+func churnStep(nodes []simNode, c string) ([]simNode, error) {
+	f := strings.Fields(c)
+	if len(f) < 2 {
+		return nil, fmt.Errorf("invalid change %q", c)
+	}
+	idx := -1
+	for i, n := range nodes {
+		if n.name == f[1] {
+			idx = i
+		}
+	}
+	weight := func() (int, error) {
+		if len(f) < 3 {
+			return 1, nil
+		}
+		w, err := strconv.Atoi(f[2])
+		if err != nil || w < 1 {
+			return 0, fmt.Errorf("invalid weight in %q", c)
+		}
+		return w, nil
+	}
+	next := append([]simNode(nil), nodes...)
+	switch f[0] {
+	case "add":
+		if idx >= 0 {
+			return nil, fmt.Errorf("%s already present", f[1])
+		}
+		w, err := weight()
+		if err != nil {
+			return nil, err
+		}
+		return append(next, simNode{f[1], w}), nil
+	case "remove":
+		if idx < 0 {
+			return nil, fmt.Errorf("unknown node %s", f[1])
+		}
+		return append(next[:idx], next[idx+1:]...), nil
+	case "weight":
+		if idx < 0 || len(f) != 3 {
+			return nil, fmt.Errorf("invalid change %q", c)
+		}
+		w, err := weight()
+		if err != nil {
+			return nil, err
+		}
+		next[idx].weight = w
+		return next, nil
+	}
+	return nil, fmt.Errorf("invalid change %q", c)
+}
+
+// every algorithm through every step of sc
+func simulate(sc *scenario) ([]result, error) {
+	initial, err := sc.init()
+	if err != nil {
+		return nil, err
+	}
+	steps := [][]simNode{initial}
+	for _, c := range sc.Churn {
+		next, err := churnStep(steps[len(steps)-1], c)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, next)
+	}
+	keys := make([]string, sc.Keys)
+	for i := range keys {
+		keys[i] = simKey(i)
+	}
+
+	var results []result
+	for _, a := range algorithms {
+		var prev []string
+		for s, nodes := range steps {
+			p, mem, err := measure(func() (placer, error) { return a.build(nodes, sc) })
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", a.name, err)
+			}
+			owners := make([]string, len(keys))
+			start := time.Now()
+			for i, k := range keys {
+				owners[i] = p.locate(k)
+			}
+			elapsed := time.Since(start)
+			r := result{
+				scenario: sc.Name,
+				algo:     a.name,
+				step:     s,
+				change:   "initial",
+				nodes:    len(nodes),
+				peak:     peak(owners, nodes),
+				memory:   mem,
+				lookupNs: float64(elapsed.Nanoseconds()) / float64(len(keys)),
+			}
+			if s > 0 {
+				r.change = sc.Churn[s-1]
+				r.moved = moved(prev, owners)
+			}
+			results = append(results, r)
+			prev = owners
+		}
+	}
+	return results, nil
+}
+
+// build and the heap it holds on to
+func measure(build func() (placer, error)) (placer, int64, error) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	p, err := build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	mem := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	if mem < 0 {
+		mem = 0
+	}
+	return p, mem, err
+}
+
+// peak of keys per node to the keys its weight share calls for,
+// the mean with equal weights
+func peak(owners []string, nodes []simNode) float64 {
+	count := make(map[string]int)
+	for _, o := range owners {
+		count[o]++
+	}
+	total := 0
+	for _, n := range nodes {
+		total += n.weight
+	}
+	max := 0.0
+	for _, n := range nodes {
+		expected := float64(len(owners)) * float64(n.weight) / float64(total)
+		if p := float64(count[n.name]) / expected; p > max {
+			max = p
+		}
+	}
+	return max
+}
+
+// fraction of keys whose owner changed
+func moved(prev, cur []string) float64 {
+	n := 0
+	for i := range cur {
+		if prev[i] != cur[i] {
+			n++
+		}
+	}
+	return float64(n) / float64(len(cur))
+}
+
+func writeCSV(w io.Writer, results []result) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"scenario", "algorithm", "step", "change", "nodes", "peak_mean", "moved_fraction", "memory_bytes", "lookup_ns"})
+	for _, r := range results {
+		cw.Write([]string{
+			r.scenario,
+			r.algo,
+			strconv.Itoa(r.step),
+			r.change,
+			strconv.Itoa(r.nodes),
+			strconv.FormatFloat(r.peak, 'f', 4, 64),
+			strconv.FormatFloat(r.moved, 'f', 6, 64),
+			strconv.FormatInt(r.memory, 10),
+			strconv.FormatFloat(r.lookupNs, 'f', 1, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// per scenario: one row per algorithm, averaged over steps
+func writeMarkdown(w io.Writer, scs []scenario, results []result) error {
+	for _, sc := range scs {
+		fmt.Fprintf(w, "## %s\n\n", sc.Name)
+		fmt.Fprintf(w, "%d nodes, %d vnodes per weight, %d keys, churn: %s\n\n",
+			sc.Nodes, sc.Vnodes, sc.Keys, strings.Join(sc.Churn, "; "))
+		fmt.Fprintf(w, "| algorithm | peak/mean | worst peak/mean | moved per change | memory KiB | lookup ns |\n")
+		fmt.Fprintf(w, "|---|---|---|---|---|---|\n")
+		for _, a := range algorithms {
+			var sumPeak, worst, sumMoved, sumNs float64
+			var steps, changes int
+			var mem int64
+			for _, r := range results {
+				if r.scenario != sc.Name || r.algo != a.name {
+					continue
+				}
+				steps++
+				sumPeak += r.peak
+				sumNs += r.lookupNs
+				if r.peak > worst {
+					worst = r.peak
+				}
+				if r.step > 0 {
+					changes++
+					sumMoved += r.moved
+				}
+				if r.memory > mem {
+					mem = r.memory
+				}
+			}
+			if steps == 0 {
+				continue
+			}
+			movedCol := "-"
+			if changes > 0 {
+				movedCol = fmt.Sprintf("%.4f", sumMoved/float64(changes))
+			}
+			fmt.Fprintf(w, "| %s | %.4f | %.4f | %s | %.1f | %.1f |\n",
+				a.name, sumPeak/float64(steps), worst, movedCol, float64(mem)/1024, sumNs/float64(steps))
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+// request cancellation on client Close
+
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// request canceled when stop or done is closed
+func cancelOnStop(req *http.Request, stop, done <-chan struct{}) (*http.Request, func()) {
+	ctx, cancel := context.WithCancel(req.Context())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-done:
+		}
+	}()
+	return req.WithContext(ctx), cancel
+}
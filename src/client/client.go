@@ -0,0 +1,297 @@
+// Go client for the cons_hring HTTP API
+// keeps a local replica of the ring, loaded from /snapshot and
+// kept fresh from /watch, and answers lookups locally
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"ring"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retry delay after the watch stream breaks
+const watchRetry = time.Second
+
+// ring client
+type Client struct {
+	base string
+	hc   *http.Client
+	mu   sync.RWMutex
+	ring *ring.Ring
+	stop chan struct{}
+	done chan struct{}
+}
+
+// connect to server at base (e.g. http://localhost:8080),
+// load the ring and follow its changes until Close
+func New(base string) (*Client, error) {
+	c := &Client{
+		base: strings.TrimRight(base, "/"),
+		hc:   &http.Client{},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	go c.watch()
+	return c, nil
+}
+
+// stop following ring changes
+func (c *Client) Close() {
+	close(c.stop)
+	<-c.done
+}
+
+// epoch of the local ring
+func (c *Client) Epoch() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.Epoch()
+}
+
+// nodes of the local ring
+func (c *Client) Nodes() []ring.Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.Nodes()
+}
+
+// node owning key
+// health is not replicated, down nodes are not skipped
+func (c *Client) Locate(key string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	node := c.ring.Locate(key, ring.Read)
+	if node == "" {
+		return "", errors.New("client: ring empty")
+	}
+	return node, nil
+}
+
+// n replicas of key, spread over zones then racks
+func (c *Client) Replicas(key string, n int) ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.Replicas(key, n, ring.Read)
+}
+
+// add node or change its options
+func (c *Client) AddNode(n ring.Node) error {
+	q := url.Values{}
+	if n.Weight > 0 {
+		q.Set("weight", strconv.Itoa(n.Weight))
+	}
+	set := func(k, v string) {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	set("state", n.State)
+	set("region", n.Region)
+	set("zone", n.Zone)
+	set("rack", n.Rack)
+	set("addr", n.Addr)
+	set("check", n.Check.Kind)
+	set("path", n.Check.Path)
+	if n.Check.Status != 0 {
+		q.Set("status", strconv.Itoa(n.Check.Status))
+	}
+	body, err := c.get("/add/" + url.PathEscape(n.Name) + "?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(body, "Added ") {
+		return errors.New("client: " + firstLine(body))
+	}
+	return c.sync()
+}
+
+// remove node
+func (c *Client) RemoveNode(name string) error {
+	body, err := c.get("/del/" + url.PathEscape(name))
+	if err != nil {
+		return err
+	}
+	line := firstLine(body)
+	if !strings.HasSuffix(line, ",val:"+name) && !strings.HasPrefix(line, "Deleted "+name+":true") {
+		return errors.New("client: " + line)
+	}
+	return c.sync()
+}
+
+// compare local answers for keys with the server's
+// returns an error naming the first key that differs
+func (c *Client) Verify(keys []string) error {
+	body, _ := json.Marshal(keys)
+	resp, err := c.hc.Post(c.base+"/locate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Epoch uint64 `json:"epoch"`
+		Keys  []struct {
+			Key  string `json:"key"`
+			Node string `json:"node"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("client: locate: %s", err)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if out.Epoch != c.ring.Epoch() {
+		return fmt.Errorf("client: epoch %d, server at %d", c.ring.Epoch(), out.Epoch)
+	}
+	for _, k := range out.Keys {
+		if local := c.ring.Locate(k.Key, ring.Read); local != k.Node {
+			return fmt.Errorf("client: key %s: local %s, server %s", k.Key, local, k.Node)
+		}
+	}
+	return nil
+}
+
+// GET path, body as text
+func (c *Client) get(path string) (string, error) {
+	resp, err := c.hc.Get(c.base + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("client: %s: %s", resp.Status, firstLine(string(b)))
+	}
+	return string(b), nil
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// replace local ring with a fresh snapshot
+func (c *Client) refresh() error {
+	req, err := http.NewRequest(http.MethodGet, c.base+"/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", ring.SnapshotBinary)
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != ring.SnapshotBinary {
+		return errors.New("client: snapshot: " + firstLine(string(data)))
+	}
+	s, err := ring.Decode(data)
+	if err != nil {
+		return fmt.Errorf("client: %s", err)
+	}
+	r, err := ring.FromSnapshot(s)
+	if err != nil {
+		return fmt.Errorf("client: %s", err)
+	}
+	c.mu.Lock()
+	c.ring = r
+	c.mu.Unlock()
+	return nil
+}
+
+// catch up after a change made through this client,
+// so it is visible before the watch stream delivers it
+func (c *Client) sync() error {
+	return c.refresh()
+}
+
+// apply event, refetch the ring if it can't be applied
+func (c *Client) handle(ev ring.Event) {
+	c.mu.Lock()
+	if ev.Epoch <= c.ring.Epoch() && ev.Kind == "change" {
+		// already seen through sync
+		c.mu.Unlock()
+		return
+	}
+	ok, _ := c.ring.ApplyEvent(ev)
+	c.mu.Unlock()
+	if !ok {
+		c.refresh()
+	}
+}
+
+// follow /watch until Close, reconnecting from the local epoch
+func (c *Client) watch() {
+	defer close(c.done)
+	for {
+		err := c.stream()
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(watchRetry):
+		}
+		if err != nil {
+			// changes may have been missed
+			c.refresh()
+		}
+	}
+}
+
+// read one SSE connection
+func (c *Client) stream() error {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/watch?since=%d", c.base, c.Epoch()), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	cancel := make(chan struct{})
+	defer close(cancel)
+	ctxReq, stopReq := cancelOnStop(req, c.stop, cancel)
+	defer stopReq()
+	resp, err := c.hc.Do(ctxReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var data []byte
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				var ev ring.Event
+				if err := json.Unmarshal(data, &ev); err == nil {
+					c.handle(ev)
+				}
+				data = data[:0]
+			}
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, line[len("data: "):]...)
+		}
+	}
+	return sc.Err()
+}
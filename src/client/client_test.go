@@ -0,0 +1,130 @@
+package client_test
+
+import (
+	"client"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"ring"
+	"ringapi"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// epoch the server is at
+func serverEpoch(t *testing.T, base string) uint64 {
+	t.Helper()
+	resp, err := http.Get(base + "/locate/epoch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	e, err := strconv.ParseUint(resp.Header.Get("X-Ring-Epoch"), 10, 64)
+	if err != nil {
+		t.Fatalf("epoch header %q", resp.Header.Get("X-Ring-Epoch"))
+	}
+	return e
+}
+
+// wait until the client has followed the server to its epoch
+func catchUp(t *testing.T, c *client.Client, base string) {
+	t.Helper()
+	want := serverEpoch(t, base)
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Epoch() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("client at epoch %d, server at %d", c.Epoch(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// node of the server's /locate answer for key
+func serverLocate(t *testing.T, base, key string) string {
+	t.Helper()
+	line := strings.SplitN(get(t, base+"/locate/"+key), "\n", 2)[0]
+	for _, f := range strings.Split(line, ",") {
+		if strings.HasPrefix(f, "node:") {
+			return f[len("node:"):]
+		}
+	}
+	t.Fatalf("locate %s: %q", key, line)
+	return ""
+}
+
+func sameAsServer(t *testing.T, c *client.Client, base string, keys []string) {
+	t.Helper()
+	for _, k := range keys {
+		local, err := c.Locate(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remote := serverLocate(t, base, k); local != remote {
+			t.Errorf("key %s: client %s, server %s", k, local, remote)
+		}
+	}
+	if err := c.Verify(keys); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLocateMatchesServer(t *testing.T) {
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	for _, create := range []string{"algorithm=bptree", "algorithm=multiprobe&probes=7", "algorithm=maglev&table=251"} {
+		t.Run(create, func(t *testing.T) {
+			ts := httptest.NewServer(ringapi.NewHandler(ringapi.Options{}))
+			defer ts.Close()
+			get(t, ts.URL+"/creat?"+create)
+			c, err := client.New(ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			// changes made through the client
+			for _, n := range []ring.Node{
+				{Name: "a", Weight: 3, Zone: "z1", Rack: "r1"},
+				{Name: "b", Weight: 1, Zone: "z1", Rack: "r2"},
+				{Name: "c", Weight: 2, Zone: "z2"},
+				{Name: "d", Zone: "z2", State: ring.StateJoining},
+			} {
+				if err := c.AddNode(n); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sameAsServer(t, c, ts.URL, keys)
+
+			// changes made by others, followed from the watch stream
+			get(t, ts.URL+"/nodes/a/state?state=draining")
+			get(t, ts.URL+"/add/e?weight=2&zone=z3")
+			get(t, ts.URL+"/nodes/d/state?state=active")
+			catchUp(t, c, ts.URL)
+			sameAsServer(t, c, ts.URL, keys)
+
+			if err := c.RemoveNode("b"); err != nil {
+				t.Fatal(err)
+			}
+			sameAsServer(t, c, ts.URL, keys)
+		})
+	}
+}
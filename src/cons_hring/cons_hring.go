@@ -6,126 +6,61 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"bptree"
-	"crypto/md5"
-	"encoding/binary"
-	"bytes"
-	"regexp"
+	"mcproxy"
+	"net"
 	"net/http"
-	"strconv"
+	"os"
+	"ringapi"
 )
 
-var validPath = regexp.MustCompile("^/(add|get|del|getN|/)/([a-zA-Z0-9.]+)$")
-var btree *bptree.Bptree
-
-func createHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-	btree, err = bptree.New(3)
-	if err != nil {
-		fmt.Fprintf(w, "%s", err)
-		return
-	}
-	fmt.Fprintf(w, "Created Ring\n")
-}
-
-func addHandler(w http.ResponseWriter, r *http.Request) {
-	m := validPath.FindStringSubmatch(r.URL.Path)
-	if m == nil {
-		fmt.Fprintf(w, "Invalid\n")
-		return
-	}
-	if btree == nil {
-		fmt.Fprintf(w, "Ring not created\n")
-		return
-	}
-	//cq := crc64.MakeTable(0xD5828281)
-	//fmt.Println(m[2])
-	//key := crc64.Checksum([]byte(m[2]), cq)
-	kmd5 := md5.Sum([]byte(m[2]))
-	var key uint64
-	_ = binary.Read(bytes.NewReader(kmd5[0:8]), binary.BigEndian, &key)
-	btree.Insert(bptree.Item(key), m[2])
-	fmt.Fprintf(w, "Added %s, key:%x\n", m[2], key)
-}
-
-func getHandler(w http.ResponseWriter, r *http.Request) {
-	m := validPath.FindStringSubmatch(r.URL.Path)
-	if m == nil {
-		fmt.Fprintf(w, "Invalid\n")
-		return
-	}
-	if btree == nil {
-		fmt.Fprintf(w, "Ring not created\n")
-		return
-	}
-	//fmt.Println(m[2])
-	//cq := crc64.MakeTable(0xD5828281)
-	//key := crc64.Checksum([]byte(m[2]), cq)
-	kmd5 := md5.Sum([]byte(m[2]))
-	var key uint64
-	_ = binary.Read(bytes.NewReader(kmd5[0:8]), binary.BigEndian, &key)
-	val := btree.Get(bptree.Item(key))
-	fmt.Fprintf(w, "key:%x,val:%s\n", key, val)
-}
-
-func delHandler(w http.ResponseWriter, r *http.Request) {
-	m := validPath.FindStringSubmatch(r.URL.Path)
-	if m == nil {
-		fmt.Fprintf(w, "Invalid\n")
-		return
-	}
-	if btree == nil {
-		fmt.Fprintf(w, "Ring not created\n")
-		return
-	}
-	//fmt.Println(m[2])
-	//cq := crc64.MakeTable(0xD5828281)
-	//key := crc64.Checksum([]byte(m[2]), cq)
-	kmd5 := md5.Sum([]byte(m[2]))
-	var key uint64
-	_ = binary.Read(bytes.NewReader(kmd5[0:8]), binary.BigEndian, &key)
-	_, val := btree.Del(bptree.Item(key))
-	fmt.Fprintf(w, "key:%x,val:%s\n", key, val)
-}
-
-func printHandler(w http.ResponseWriter, r *http.Request) {
-	if btree == nil {
-		fmt.Fprintf(w, "Ring not created\n")
-		return
+func main() {
+	reg := ringapi.NewRegistry()
+	addr := flag.String("addr", ":8080", "listen address")
+	prefix := flag.String("prefix", "", "path prefix of the API")
+	flag.DurationVar(&reg.Health.Interval, "check-interval", reg.Health.Interval, "health check interval")
+	flag.DurationVar(&reg.Health.Timeout, "check-timeout", reg.Health.Timeout, "health check timeout")
+	flag.IntVar(&reg.Health.Fall, "check-fall", reg.Health.Fall, "consecutive failures to mark a node down")
+	flag.IntVar(&reg.Health.Rise, "check-rise", reg.Health.Rise, "consecutive successes to mark a node up")
+	proxyAddr := flag.String("proxy", "", "also serve a reverse proxy on this address")
+	proxyRing := flag.String("proxy-ring", ringapi.DefaultRing, "ring the proxy routes on")
+	proxyKey := flag.String("proxy-key", "path", "proxy key: path, path:N, query:name, header:name or cookie:name")
+	proxyRetries := flag.Int("proxy-retries", 1, "further replicas tried when a backend cannot be dialed")
+	proxyMaxBody := flag.Int64("proxy-max-body", ringapi.DefaultMaxBody, "largest request body the proxy holds for a retry")
+	mcAddr := flag.String("memcache", "", "also serve a memcached proxy on this address")
+	mcRing := flag.String("memcache-ring", ringapi.DefaultRing, "ring the memcached proxy routes on")
+	flag.Parse()
+	if err := reg.Health.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "cons_hring: %s\n", err)
+		os.Exit(2)
 	}
-	//fmt.Println(m[2])
-	btree.Print(w)
-}
 
-func getNHandler(w http.ResponseWriter, r *http.Request) {
-	m := validPath.FindStringSubmatch(r.URL.Path)
-	if m == nil {
-		fmt.Fprintf(w, "Invalid\n")
-		return
-	}
-	if btree == nil {
-		fmt.Fprintf(w, "Ring not created\n")
-		return
+	if *proxyAddr != "" {
+		p, err := ringapi.NewProxy(ringapi.ProxyOptions{Registry: reg, Ring: *proxyRing, Key: *proxyKey, Retries: *proxyRetries, MaxBody: *proxyMaxBody})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cons_hring: %s\n", err)
+			os.Exit(2)
+		}
+		// listen here so a taken port stops the server at start
+		ln, err := net.Listen("tcp", *proxyAddr)
+		if err != nil {
+			fail(err)
+		}
+		go func() { fail(http.Serve(ln, p)) }()
 	}
-	//fmt.Println(m[2])
-	//cq := crc64.MakeTable(0xD5828281)
-	key, err := strconv.Atoi(m[2])
-	if err != nil {
-		fmt.Fprintf(w, "Invalid key\n")
-		return
+	if *mcAddr != "" {
+		ln, err := net.Listen("tcp", *mcAddr)
+		if err != nil {
+			fail(err)
+		}
+		go func() { fail(mcproxy.New(reg, *mcRing).Serve(ln)) }()
 	}
-	val := btree.GetNextN(bptree.Item(key), 3)
-	fmt.Fprintf(w, "key:%d,val:%s\n", key, val)
+	http.Handle("/", ringapi.NewHandler(ringapi.Options{Prefix: *prefix, Registry: reg}))
+	fail(http.ListenAndServe(*addr, nil))
 }
 
-func main() {
-
-	http.HandleFunc("/creat", createHandler)
-	http.HandleFunc("/add/", addHandler)
-	http.HandleFunc("/get/", getHandler)
-	http.HandleFunc("/del/", delHandler)
-	http.HandleFunc("/getN/", getNHandler)
-	http.HandleFunc("/print", printHandler)
-	http.ListenAndServe(":8080", nil)
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "cons_hring: %s\n", err)
+	os.Exit(1)
 }
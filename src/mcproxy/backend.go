@@ -0,0 +1,118 @@
+// Memcached backends
+// idle connections kept per address and reused across requests
+
+package mcproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idle connections kept per backend
+const maxIdle = 8
+
+var errBackend = errors.New("backend error")
+
+// connection to a memcached backend
+type backend struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// idle or new connection to addr
+func (p *Proxy) dial(addr string) (*backend, error) {
+	p.mu.Lock()
+	if conns := p.idle[addr]; len(conns) > 0 {
+		b := conns[len(conns)-1]
+		p.idle[addr] = conns[:len(conns)-1]
+		p.mu.Unlock()
+		return b, nil
+	}
+	p.mu.Unlock()
+	c, err := net.DialTimeout("tcp", addr, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &backend{conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}, nil
+}
+
+// return b for reuse, close it past maxIdle
+func (p *Proxy) release(addr string, b *backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[addr]) < maxIdle {
+		p.idle[addr] = append(p.idle[addr], b)
+		return
+	}
+	b.conn.Close()
+}
+
+// send req to addr and read the reply with read
+// the connection is dropped on any error, as it may be out of step
+func (p *Proxy) exchange(addr string, req []byte, read func(*backend) error) error {
+	b, err := p.dial(addr)
+	if err != nil {
+		return err
+	}
+	b.conn.SetDeadline(time.Now().Add(p.Timeout))
+	if _, err = b.w.Write(req); err == nil {
+		err = b.w.Flush()
+	}
+	if err == nil {
+		err = read(b)
+	}
+	if err != nil {
+		b.conn.Close()
+		return err
+	}
+	p.release(addr, b)
+	return nil
+}
+
+// one reply line, with its \r\n
+func (b *backend) line() (string, error) {
+	l, err := b.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(l, "\r\n") {
+		return "", errBackend
+	}
+	return l, nil
+}
+
+// VALUE blocks of a get reply by key, raw, up to END
+func (b *backend) values(out map[string][]byte) error {
+	for {
+		l, err := b.line()
+		if err != nil {
+			return err
+		}
+		if l == "END\r\n" {
+			return nil
+		}
+		f := strings.Fields(l)
+		if len(f) < 4 || f[0] != "VALUE" {
+			return errors.New(strings.TrimSpace(l))
+		}
+		n, err := strconv.Atoi(f[3])
+		if err != nil || n < 0 {
+			return errBackend
+		}
+		block := make([]byte, len(l)+n+2)
+		copy(block, l)
+		if _, err := io.ReadFull(b.r, block[len(l):]); err != nil {
+			return err
+		}
+		if string(block[len(block)-2:]) != "\r\n" {
+			return errBackend
+		}
+		out[f[1]] = block
+	}
+}
@@ -0,0 +1,333 @@
+// Memcached sharding proxy
+// accepts the memcached text protocol and routes every key to its
+// owner on a served ring, looked up per request so membership
+// changes apply at once; multi key gets fan out to the owners and
+// are answered in request order
+//
+// commands: get, gets, set, add, delete, incr, touch, version, quit
+
+package mcproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"ring"
+	"ringapi"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxKey     = 250      // memcached key limit
+	maxValue   = 1 << 20  // memcached default item size
+	maxLine    = 2048     // command line limit
+	maxGetLine = 64 << 10 // get and gets lines, a couple hundred keys
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// memcached proxy over ring Ring of Registry
+type Proxy struct {
+	Registry *ringapi.Registry
+	Ring     string
+	Timeout  time.Duration // backend dial and exchange
+
+	mu   sync.Mutex
+	idle map[string][]*backend
+}
+
+func New(reg *ringapi.Registry, name string) *Proxy {
+	if name == "" {
+		name = ringapi.DefaultRing
+	}
+	return &Proxy{Registry: reg, Ring: name, Timeout: time.Second, idle: make(map[string][]*backend)}
+}
+
+func (p *Proxy) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return p.Serve(ln)
+}
+
+// serve client connections from ln until it fails
+func (p *Proxy) Serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveConn(c)
+	}
+}
+
+func (p *Proxy) serveConn(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	for {
+		l, err := readLine(r)
+		if err == errLineTooLong {
+			// the rest of the line cannot be told from the next command
+			fmt.Fprintf(w, "CLIENT_ERROR %s\r\n", err)
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		f := strings.Fields(l)
+		if len(f) == 0 {
+			fmt.Fprintf(w, "ERROR\r\n")
+			w.Flush()
+			continue
+		}
+		switch f[0] {
+		case "get", "gets":
+			p.get(w, f)
+		case "set", "add":
+			if !p.store(r, w, f) {
+				w.Flush()
+				return
+			}
+		case "delete":
+			p.simple(w, f, 1)
+		case "incr", "touch":
+			p.simple(w, f, 2)
+		case "version":
+			fmt.Fprintf(w, "VERSION cons_hring\r\n")
+		case "quit":
+			w.Flush()
+			return
+		default:
+			fmt.Fprintf(w, "ERROR\r\n")
+		}
+		// answer pipelined commands together
+		if r.Buffered() == 0 {
+			w.Flush()
+		}
+	}
+}
+
+// next command line, up to maxLine bytes, maxGetLine for a get
+func readLine(r *bufio.Reader) (string, error) {
+	var l []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		l = append(l, b...)
+		limit := maxLine
+		if bytes.HasPrefix(l, []byte("get ")) || bytes.HasPrefix(l, []byte("gets ")) {
+			limit = maxGetLine
+		}
+		if len(l) > limit {
+			return "", errLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return string(l), err
+		}
+	}
+}
+
+// memcached key: 1 to maxKey bytes, no control characters or spaces,
+// which would break the line protocol to the backend
+func validKey(k string) bool {
+	if len(k) == 0 || len(k) > maxKey {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		if k[i] <= ' ' || k[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// backend address of each key; false if ring is missing
+// keys whose owner has no address get ""
+func (p *Proxy) route(keys []string, op ring.Access) ([]string, bool) {
+	addrs := make([]string, len(keys))
+	found := p.Registry.Read(p.Ring, func(r *ring.Ring) {
+		for i, k := range keys {
+			if n, ok := r.Node(r.Locate(k, op)); ok {
+				addrs[i] = n.Addr
+			}
+		}
+	})
+	return addrs, found
+}
+
+// route one key, writing the error reply if it cannot be
+func (p *Proxy) routeKey(w io.Writer, key string, op ring.Access) (string, bool) {
+	addrs, found := p.route([]string{key}, op)
+	if !found {
+		fmt.Fprintf(w, "SERVER_ERROR no ring %s\r\n", p.Ring)
+		return "", false
+	}
+	if addrs[0] == "" {
+		fmt.Fprintf(w, "SERVER_ERROR no node for key\r\n")
+		return "", false
+	}
+	return addrs[0], true
+}
+
+// get/gets k...: one request per owner, values in request order
+func (p *Proxy) get(w io.Writer, f []string) {
+	keys := f[1:]
+	if len(keys) == 0 {
+		fmt.Fprintf(w, "ERROR\r\n")
+		return
+	}
+	for _, k := range keys {
+		if !validKey(k) {
+			fmt.Fprintf(w, "CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+	}
+	addrs, found := p.route(keys, ring.Read)
+	if !found {
+		fmt.Fprintf(w, "SERVER_ERROR no ring %s\r\n", p.Ring)
+		return
+	}
+	// distinct keys per backend, first seen order
+	var order []string
+	byAddr := make(map[string][]string)
+	seen := make(map[string]bool)
+	for i, k := range keys {
+		if addrs[i] == "" {
+			fmt.Fprintf(w, "SERVER_ERROR no node for key\r\n")
+			return
+		}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if _, ok := byAddr[addrs[i]]; !ok {
+			order = append(order, addrs[i])
+		}
+		byAddr[addrs[i]] = append(byAddr[addrs[i]], k)
+	}
+
+	results := make([]map[string][]byte, len(order))
+	errs := make([]error, len(order))
+	var wg sync.WaitGroup
+	for i, addr := range order {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			req := f[0] + " " + strings.Join(byAddr[addr], " ") + "\r\n"
+			results[i] = make(map[string][]byte)
+			errs[i] = p.exchange(addr, []byte(req), func(b *backend) error {
+				return b.values(results[i])
+			})
+		}(i, addr)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			fmt.Fprintf(w, "SERVER_ERROR %s\r\n", err)
+			return
+		}
+	}
+	values := make(map[string][]byte)
+	for _, res := range results {
+		for k, v := range res {
+			values[k] = v
+		}
+	}
+	for _, k := range keys {
+		if v, ok := values[k]; ok {
+			w.Write(v)
+		}
+	}
+	fmt.Fprintf(w, "END\r\n")
+}
+
+// set/add key flags exptime bytes [noreply], then the data block
+// false if the client connection is out of step and must be closed
+func (p *Proxy) store(r *bufio.Reader, w io.Writer, f []string) bool {
+	if len(f) != 5 && len(f) != 6 {
+		fmt.Fprintf(w, "ERROR\r\n")
+		return true
+	}
+	n, err := strconv.Atoi(f[4])
+	if err != nil || n < 0 {
+		fmt.Fprintf(w, "CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+	if !validKey(f[1]) {
+		// swallow the data block
+		if _, err := io.CopyN(io.Discard, r, int64(n)+2); err != nil {
+			return false
+		}
+		fmt.Fprintf(w, "CLIENT_ERROR bad command line format\r\n")
+		return true
+	}
+	if n > maxValue {
+		if _, err := io.CopyN(io.Discard, r, int64(n)+2); err != nil {
+			return false
+		}
+		fmt.Fprintf(w, "SERVER_ERROR object too large for cache\r\n")
+		return true
+	}
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return false
+	}
+	if string(data[n:]) != "\r\n" {
+		fmt.Fprintf(w, "CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+	noreply := len(f) == 6 && f[5] == "noreply"
+	addr, ok := p.routeKey(w, f[1], ring.Write)
+	if !ok {
+		return true
+	}
+	req := append([]byte(strings.Join(f[:5], " ")+"\r\n"), data...)
+	p.forward(w, addr, req, noreply)
+	return true
+}
+
+// delete, incr and touch: args fields after the command, then [noreply]
+func (p *Proxy) simple(w io.Writer, f []string, args int) {
+	noreply := len(f) == args+2 && f[args+1] == "noreply"
+	if len(f) != args+1 && !noreply {
+		fmt.Fprintf(w, "ERROR\r\n")
+		return
+	}
+	if !validKey(f[1]) {
+		fmt.Fprintf(w, "CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	addr, ok := p.routeKey(w, f[1], ring.Write)
+	if !ok {
+		return
+	}
+	p.forward(w, addr, []byte(strings.Join(f[:args+1], " ")+"\r\n"), noreply)
+}
+
+// send a single reply command to addr and relay the reply line
+// noreply is not passed on, the reply is read and dropped here
+// so the backend connection stays in step
+func (p *Proxy) forward(w io.Writer, addr string, req []byte, noreply bool) {
+	var reply string
+	err := p.exchange(addr, req, func(b *backend) error {
+		var err error
+		reply, err = b.line()
+		return err
+	})
+	if noreply {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(w, "SERVER_ERROR %s\r\n", err)
+		return
+	}
+	io.WriteString(w, reply)
+}
@@ -0,0 +1,367 @@
+package mcproxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mcproxy"
+	"net"
+	"ring"
+	"ringapi"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in-memory memcached backend, enough of the text protocol for the proxy
+type fakeServer struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	data map[string]string // key -> "flags data"
+	cmds []string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, data: make(map[string]string)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+// commands received, data blocks left out
+func (s *fakeServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.cmds...)
+}
+
+func (s *fakeServer) value(k string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[k]
+	return v, ok
+}
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(l)
+		var block []byte
+		if len(f) == 5 && (f[0] == "set" || f[0] == "add") {
+			n, _ := strconv.Atoi(f[4])
+			block = make([]byte, n+2)
+			if _, err := io.ReadFull(r, block); err != nil {
+				return
+			}
+		}
+		s.mu.Lock()
+		s.cmds = append(s.cmds, strings.TrimSpace(l))
+		reply := s.do(f, block)
+		s.mu.Unlock()
+		if _, err := io.WriteString(c, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) do(f []string, block []byte) string {
+	switch f[0] {
+	case "get", "gets":
+		var b strings.Builder
+		for _, k := range f[1:] {
+			if v, ok := s.data[k]; ok {
+				flags, data, _ := strings.Cut(v, " ")
+				if f[0] == "gets" {
+					fmt.Fprintf(&b, "VALUE %s %s %d 1\r\n%s\r\n", k, flags, len(data), data)
+				} else {
+					fmt.Fprintf(&b, "VALUE %s %s %d\r\n%s\r\n", k, flags, len(data), data)
+				}
+			}
+		}
+		return b.String() + "END\r\n"
+	case "set", "add":
+		if _, ok := s.data[f[1]]; ok && f[0] == "add" {
+			return "NOT_STORED\r\n"
+		}
+		s.data[f[1]] = f[2] + " " + string(block[:len(block)-2])
+		return "STORED\r\n"
+	case "delete":
+		if _, ok := s.data[f[1]]; !ok {
+			return "NOT_FOUND\r\n"
+		}
+		delete(s.data, f[1])
+		return "DELETED\r\n"
+	case "incr":
+		v, ok := s.data[f[1]]
+		if !ok {
+			return "NOT_FOUND\r\n"
+		}
+		flags, data, _ := strings.Cut(v, " ")
+		n, _ := strconv.Atoi(data)
+		d, _ := strconv.Atoi(f[2])
+		s.data[f[1]] = flags + " " + strconv.Itoa(n+d)
+		return strconv.Itoa(n+d) + "\r\n"
+	case "touch":
+		if _, ok := s.data[f[1]]; !ok {
+			return "NOT_FOUND\r\n"
+		}
+		return "TOUCHED\r\n"
+	}
+	return "ERROR\r\n"
+}
+
+// proxy over the default ring of backends name -> addr
+type testProxy struct {
+	ring *ring.Ring
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestProxy(t *testing.T, addrs map[string]string) *testProxy {
+	t.Helper()
+	r, err := ring.New(ring.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, addr := range addrs {
+		if _, err := r.Add(ring.Node{Name: name, Addr: addr}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reg := ringapi.NewRegistry()
+	reg.Register(ringapi.DefaultRing, r)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := mcproxy.New(reg, "")
+	p.Timeout = 200 * time.Millisecond
+	go p.Serve(ln)
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testProxy{ring: r, conn: c, r: bufio.NewReader(c)}
+}
+
+func (p *testProxy) send(t *testing.T, req string) {
+	t.Helper()
+	if _, err := io.WriteString(p.conn, req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// next n reply lines, without \r\n
+func (p *testProxy) lines(t *testing.T, n int) []string {
+	t.Helper()
+	out := make([]string, n)
+	for i := range out {
+		l, err := p.r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(l, "\r\n") {
+			t.Fatalf("reply line %q", l)
+		}
+		out[i] = strings.TrimSuffix(l, "\r\n")
+	}
+	return out
+}
+
+func (p *testProxy) expect(t *testing.T, req string, want ...string) {
+	t.Helper()
+	p.send(t, req)
+	got := p.lines(t, len(want))
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("%q: got %q, want %q", req, got, want)
+	}
+}
+
+// a key owned by node
+func (p *testProxy) keyOf(t *testing.T, node string) string {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("%s-key%d", node, i)
+		if p.ring.Locate(k, ring.Write) == node {
+			return k
+		}
+	}
+	t.Fatalf("no key owned by %s", node)
+	return ""
+}
+
+func TestStoreRouting(t *testing.T) {
+	a, b := newFakeServer(t), newFakeServer(t)
+	p := newTestProxy(t, map[string]string{"a": a.addr(), "b": b.addr()})
+	ka, kb := p.keyOf(t, "a"), p.keyOf(t, "b")
+
+	p.expect(t, "set "+ka+" 5 0 3\r\none\r\n", "STORED")
+	p.expect(t, "set "+kb+" 0 0 2\r\n10\r\n", "STORED")
+	if v, ok := a.value(ka); !ok || v != "5 one" {
+		t.Errorf("backend a %s: %q", ka, v)
+	}
+	if _, ok := b.value(ka); ok {
+		t.Errorf("backend b got %s", ka)
+	}
+	if v, ok := b.value(kb); !ok || v != "0 10" {
+		t.Errorf("backend b %s: %q", kb, v)
+	}
+
+	p.expect(t, "add "+ka+" 0 0 1\r\nx\r\n", "NOT_STORED")
+	p.expect(t, "incr "+kb+" 5\r\n", "15")
+	p.expect(t, "touch "+ka+" 10\r\n", "TOUCHED")
+	p.expect(t, "delete "+ka+"\r\n", "DELETED")
+	p.expect(t, "delete "+ka+"\r\n", "NOT_FOUND")
+	if _, ok := a.value(ka); ok {
+		t.Errorf("backend a kept %s", ka)
+	}
+	for _, cmd := range b.received() {
+		if strings.Contains(cmd, ka) {
+			t.Errorf("backend b received %q", cmd)
+		}
+	}
+	p.expect(t, "version\r\n", "VERSION cons_hring")
+}
+
+func TestGetFanOut(t *testing.T) {
+	a, b := newFakeServer(t), newFakeServer(t)
+	p := newTestProxy(t, map[string]string{"a": a.addr(), "b": b.addr()})
+	ka, kb, ka2 := p.keyOf(t, "a"), p.keyOf(t, "b"), p.keyOf(t, "a")+"x"
+	for p.ring.Locate(ka2, ring.Read) != "a" {
+		ka2 += "x"
+	}
+	p.expect(t, "set "+ka+" 1 0 2\r\nva\r\n", "STORED")
+	p.expect(t, "set "+kb+" 2 0 2\r\nvb\r\n", "STORED")
+
+	// values in request order across backends, missing keys left out
+	p.expect(t, "get "+kb+" missing "+ka+" "+kb+"\r\n",
+		"VALUE "+kb+" 2 2", "vb", "VALUE "+ka+" 1 2", "va", "VALUE "+kb+" 2 2", "vb", "END")
+	p.expect(t, "gets "+ka+" "+ka2+"\r\n", "VALUE "+ka+" 1 2 1", "va", "END")
+
+	// one request per backend, each with its own keys
+	gets := func(s *fakeServer) []string {
+		var out []string
+		for _, cmd := range s.received() {
+			if strings.HasPrefix(cmd, "get") {
+				out = append(out, cmd)
+			}
+		}
+		return out
+	}
+	wantA, wantB := "get "+ka, "get "+kb
+	if p.ring.Locate("missing", ring.Read) == "a" {
+		wantA = "get missing " + ka
+	} else {
+		wantB = "get " + kb + " missing"
+	}
+	ga, gb := gets(a), gets(b)
+	if len(ga) != 2 || ga[0] != wantA || ga[1] != "gets "+ka+" "+ka2 {
+		t.Errorf("backend a gets: %q, want %q", ga, wantA)
+	}
+	if len(gb) != 1 || gb[0] != wantB {
+		t.Errorf("backend b gets: %q, want %q", gb, wantB)
+	}
+}
+
+func TestNoreply(t *testing.T) {
+	a := newFakeServer(t)
+	p := newTestProxy(t, map[string]string{"a": a.addr()})
+	// only the get is answered
+	p.send(t, "set k 0 0 1 noreply\r\n5\r\nincr k 1 noreply\r\ndelete nope noreply\r\n")
+	p.expect(t, "get k\r\n", "VALUE k 0 1", "6", "END")
+	// the backend never sees noreply and stays in step
+	for _, cmd := range a.received() {
+		if strings.HasSuffix(cmd, "noreply") {
+			t.Errorf("backend received %q", cmd)
+		}
+	}
+	if len(a.received()) != 4 {
+		t.Errorf("backend received %q", a.received())
+	}
+}
+
+func TestBackendDown(t *testing.T) {
+	a := newFakeServer(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+	p := newTestProxy(t, map[string]string{"a": a.addr(), "down": dead})
+	ka, kd := p.keyOf(t, "a"), p.keyOf(t, "down")
+
+	p.send(t, "set "+kd+" 0 0 1\r\nx\r\n")
+	if l := p.lines(t, 1)[0]; !strings.HasPrefix(l, "SERVER_ERROR ") {
+		t.Errorf("set on down backend: %q", l)
+	}
+	p.send(t, "get "+ka+" "+kd+"\r\n")
+	if l := p.lines(t, 1)[0]; !strings.HasPrefix(l, "SERVER_ERROR ") {
+		t.Errorf("get on down backend: %q", l)
+	}
+	// the client connection is still usable
+	p.expect(t, "set "+ka+" 0 0 1\r\ny\r\n", "STORED")
+}
+
+func TestBadKey(t *testing.T) {
+	a := newFakeServer(t)
+	p := newTestProxy(t, map[string]string{"a": a.addr()})
+	long := strings.Repeat("k", 251)
+	p.expect(t, "get "+long+"\r\n", "CLIENT_ERROR bad command line format")
+	p.expect(t, "delete "+long+"\r\n", "CLIENT_ERROR bad command line format")
+	// the data block of a rejected set is skipped
+	p.expect(t, "set "+long+" 0 0 3\r\nabc\r\n", "CLIENT_ERROR bad command line format")
+	p.expect(t, "set k\x01 0 0 1\r\nx\r\n", "CLIENT_ERROR bad command line format")
+	p.expect(t, "set k 0 0 1\r\nx\r\n", "STORED")
+	if len(a.received()) != 1 {
+		t.Errorf("backend received %q", a.received())
+	}
+	p.expect(t, "bogus\r\n", "ERROR")
+}
+
+func TestLineTooLong(t *testing.T) {
+	a := newFakeServer(t)
+	p := newTestProxy(t, map[string]string{"a": a.addr()})
+	// a get may name many keys
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%0200d", i)
+	}
+	p.expect(t, "get "+strings.Join(keys, " ")+"\r\n", "END")
+	p.expect(t, "delete "+strings.Repeat("k", 3000)+"\r\n", "CLIENT_ERROR line too long")
+	if l, err := p.r.ReadString('\n'); err == nil {
+		t.Errorf("connection left open, read %q", l)
+	}
+	for _, cmd := range a.received() {
+		if !strings.HasPrefix(cmd, "get ") {
+			t.Errorf("backend received %.20q", cmd)
+		}
+	}
+}
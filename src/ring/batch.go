@@ -0,0 +1,223 @@
+// Atomic batch of membership changes
+// all ops validated before any is applied, one epoch bump
+// also the unit of change recorded in the history
+
+package ring
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// largest node weight, a bptree node gets one point per unit
+const MaxWeight = 1024
+
+var validName = regexp.MustCompile("^[a-zA-Z0-9.]+$")
+
+// add, remove, weight or state op
+type Op struct {
+	Op     string `json:"op"`
+	Node   string `json:"node"`
+	Weight int    `json:"weight,omitempty"`
+	State  string `json:"state,omitempty"`
+	Region string `json:"region,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+	Rack   string `json:"rack,omitempty"`
+	Addr   string `json:"addr,omitempty"`
+	Check  string `json:"check,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// op adding node n
+func AddOp(n Node) Op {
+	op := Op{
+		Op:     "add",
+		Node:   n.Name,
+		Weight: n.Weight,
+		State:  n.State,
+		Region: n.Region,
+		Zone:   n.Zone,
+		Rack:   n.Rack,
+		Addr:   n.Addr,
+		Check:  n.Check.Kind,
+	}
+	if n.Check.Kind == CheckHTTP {
+		op.Path = n.Check.Path
+		op.Status = n.Check.Status
+	}
+	return op
+}
+
+// member for an add op, in resolved state
+func (op *Op) member(state string) (*member, error) {
+	status := ""
+	if op.Status != 0 {
+		status = fmt.Sprint(op.Status)
+	}
+	check, err := ParseCheck(op.Check, op.Path, status)
+	if err != nil {
+		return nil, err
+	}
+	if check.Kind != CheckNone && op.Addr == "" {
+		return nil, fmt.Errorf("Health check needs addr")
+	}
+	return &member{Node: Node{
+		Name:   op.Node,
+		Weight: op.Weight,
+		State:  state,
+		Region: op.Region,
+		Zone:   op.Zone,
+		Rack:   op.Rack,
+		Addr:   op.Addr,
+		Check:  check,
+	}}, nil
+}
+
+// error of op i of a batch
+type opError struct {
+	op  int
+	err error
+}
+
+func (e *opError) Error() string {
+	return fmt.Sprintf("op %d: %s", e.op, e.err)
+}
+
+func opErr(i int, format string, args ...interface{}) error {
+	return &opError{i, fmt.Errorf(format, args...)}
+}
+
+// validate ops against the membership they will see,
+// returns the members to put (nil for remove); ops are not changed
+func (r *Ring) checkBatch(ops []Op) ([]*member, error) {
+	present := make(map[string]*member, len(r.members))
+	for name, m := range r.members {
+		present[name] = m
+	}
+	puts := make([]*member, len(ops))
+	for i := range ops {
+		op := &ops[i]
+		if !validName.MatchString(op.Node) {
+			return nil, opErr(i, "Invalid node %q", op.Node)
+		}
+		if op.Weight < 0 || op.Weight > MaxWeight {
+			return nil, opErr(i, "Invalid weight %d, max %d", op.Weight, MaxWeight)
+		}
+		switch op.Op {
+		case "add":
+			// re-adding changes weight or labels, not the lifecycle,
+			// unless a state is given
+			state := op.State
+			if old := present[op.Node]; old != nil && (state == "" || state == old.State) {
+				state = old.State
+			} else {
+				s, err := ParseInitialState(state)
+				if err != nil {
+					return nil, &opError{i, err}
+				}
+				if old != nil && !canTransition(old.State, s) {
+					return nil, opErr(i, "Invalid transition %s -> %s", old.State, s)
+				}
+				state = s
+			}
+			m, err := op.member(state)
+			if err != nil {
+				return nil, &opError{i, err}
+			}
+			puts[i] = m
+			present[op.Node] = m
+		case "remove":
+			if present[op.Node] == nil {
+				return nil, opErr(i, "Unknown node %s", op.Node)
+			}
+			present[op.Node] = nil
+		case "weight":
+			old := present[op.Node]
+			if old == nil {
+				return nil, opErr(i, "Unknown node %s", op.Node)
+			}
+			if op.Weight < 1 {
+				return nil, opErr(i, "Invalid weight %d", op.Weight)
+			}
+			m := *old
+			m.Weight = op.Weight
+			m.points = nil
+			puts[i] = &m
+			present[op.Node] = &m
+		case "state":
+			old := present[op.Node]
+			if old == nil {
+				return nil, opErr(i, "Unknown node %s", op.Node)
+			}
+			if old.State != op.State && !canTransition(old.State, op.State) {
+				return nil, opErr(i, "Invalid transition %s -> %s", old.State, op.State)
+			}
+			if op.State == StateRemoved {
+				present[op.Node] = nil
+				break
+			}
+			m := *old
+			m.State = op.State
+			m.points = nil
+			puts[i] = &m
+			present[op.Node] = &m
+		default:
+			return nil, opErr(i, "Unknown op %q", op.Op)
+		}
+	}
+	return puts, nil
+}
+
+// op in history form
+func (op Op) String() string {
+	switch op.Op {
+	case "add":
+		s := fmt.Sprintf("add %s weight=%d state=%s", op.Node, op.Weight, op.State)
+		if op.Zone != "" || op.Rack != "" || op.Region != "" {
+			s += fmt.Sprintf(" topo=%s/%s/%s", op.Region, op.Zone, op.Rack)
+		}
+		if op.Addr != "" {
+			s += " addr=" + op.Addr
+		}
+		if op.Check != "" {
+			s += " check=" + op.Check
+		}
+		return s
+	case "weight":
+		return fmt.Sprintf("weight %s %d", op.Node, op.Weight)
+	case "state":
+		return fmt.Sprintf("state %s %s", op.Node, op.State)
+	}
+	return op.Op + " " + op.Node
+}
+
+// apply all ops or none, with one epoch bump, recorded in the
+// history as one change; errors name the failing op
+// returns number of maglev table entries moved
+func (r *Ring) Apply(ops []Op) (int, error) {
+	return r.apply(r.actor, ops)
+}
+
+func (r *Ring) apply(who string, ops []Op) (int, error) {
+	puts, err := r.checkBatch(ops)
+	if err != nil {
+		return 0, err
+	}
+	// recorded as placed: resolved state, normalized weight
+	placed := append([]Op(nil), ops...)
+	for i := range ops {
+		if puts[i] != nil {
+			r.put(puts[i])
+		} else {
+			r.drop(ops[i].Node)
+		}
+		if placed[i].Op == "add" {
+			placed[i].State = puts[i].State
+			placed[i].Weight = puts[i].Weight
+		}
+	}
+	moved := r.commit()
+	r.record(who, nil, placed...)
+	return moved, nil
+}
@@ -0,0 +1,103 @@
+// Consistent hashing with bounded loads (Mirrokni et al, SODA 2018)
+// a key goes to the first node clockwise whose load is under
+// ceil(c * average load)
+
+package ring
+
+import (
+	"bptree"
+	"errors"
+	"math"
+	"strconv"
+)
+
+const DefaultLoadFactor = 1.25
+
+// assigned load per node
+type loadTracker struct {
+	load     map[string]int
+	assigned map[string]string // key -> node
+	total    int
+}
+
+func newLoadTracker() *loadTracker {
+	return &loadTracker{load: make(map[string]int), assigned: make(map[string]string)}
+}
+
+// parse load factor c, must be >= 1
+func ParseLoadFactor(s string) (float64, error) {
+	if s == "" {
+		return DefaultLoadFactor, nil
+	}
+	c, err := strconv.ParseFloat(s, 64)
+	if err != nil || c < 1 {
+		return 0, errors.New("Invalid load factor " + s)
+	}
+	return c, nil
+}
+
+// max load per node once one more key is placed
+func (lt *loadTracker) capacity(c float64, nodes int) int {
+	return int(math.Ceil(c * float64(lt.total+1) / float64(nodes)))
+}
+
+// assign key to a node under the load cap
+// a key already assigned keeps its node
+// new assignments are placements, treated as writes
+func (r *Ring) Acquire(name string, c float64) (string, error) {
+	if r.tree == nil {
+		return "", errors.New("Not supported by " + r.algo + " ring")
+	}
+	lt := r.loads
+	if node, ok := lt.assigned[name]; ok {
+		return node, nil
+	}
+	if len(r.members) == 0 {
+		return "", errors.New("Ring empty")
+	}
+	limit := lt.capacity(c, len(r.members))
+	node := ""
+	r.tree.Walk(bptree.Item(HashKey(name)), func(_ bptree.Item, v string) bool {
+		if lt.load[v] < limit && r.usable(v, Write) {
+			node = v
+			return false
+		}
+		return true
+	})
+	if node == "" {
+		return "", errors.New("All nodes at capacity")
+	}
+	lt.assigned[name] = node
+	lt.load[node]++
+	lt.total++
+	return node, nil
+}
+
+// keys assigned to node
+func (r *Ring) Load(node string) int {
+	return r.loads.load[node]
+}
+
+// release key assigned by acquire
+func (r *Ring) Release(name string) (string, bool) {
+	lt := r.loads
+	node, ok := lt.assigned[name]
+	if !ok {
+		return "", false
+	}
+	delete(lt.assigned, name)
+	lt.load[node]--
+	lt.total--
+	return node, true
+}
+
+// drop keys assigned to a removed node
+func (lt *loadTracker) dropNode(node string) {
+	for k, v := range lt.assigned {
+		if v == node {
+			delete(lt.assigned, k)
+		}
+	}
+	lt.total -= lt.load[node]
+	delete(lt.load, node)
+}
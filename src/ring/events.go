@@ -0,0 +1,76 @@
+// Change events
+// membership changes from the history in a form subscribers can
+// apply to their own copy; too far behind gets a snapshot
+
+package ring
+
+import "time"
+
+// max changes replayed before a snapshot
+const eventBacklog = 1024
+
+// change or snapshot event
+type Event struct {
+	Kind      string `json:"kind"` // change or snapshot
+	Epoch     uint64 `json:"epoch"`
+	At        string `json:"at,omitempty"`
+	Actor     string `json:"actor,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Table     int    `json:"table,omitempty"`
+	Probes    int    `json:"probes,omitempty"`
+	Ops       []Op   `json:"ops"`
+}
+
+// full ring at current epoch
+func (r *Ring) SnapshotEvent() Event {
+	ev := Event{Kind: "snapshot", Epoch: r.epoch, Algorithm: r.algo, Ops: (&Snapshot{Nodes: r.snapshotNodes()}).Ops()}
+	switch r.algo {
+	case AlgoMaglev:
+		ev.Table = r.table.size
+	case AlgoMultiprobe:
+		ev.Probes = r.probes
+	}
+	return ev
+}
+
+// changes after epoch since, or a snapshot when they are
+// too many or the ring was re-created in between
+func (r *Ring) Events(since uint64) []Event {
+	if since >= r.epoch {
+		return nil
+	}
+	var evs []Event
+	for _, c := range r.history {
+		if c.epoch <= since {
+			continue
+		}
+		if c.create != nil || len(evs) == eventBacklog {
+			return []Event{r.SnapshotEvent()}
+		}
+		evs = append(evs, Event{
+			Kind:  "change",
+			Epoch: c.epoch,
+			At:    c.at.Format(time.RFC3339),
+			Actor: c.actor,
+			Ops:   append([]Op(nil), c.ops...),
+		})
+	}
+	if len(evs) == 0 || evs[0].Epoch != since+1 {
+		// since predates the history of this ring
+		return []Event{r.SnapshotEvent()}
+	}
+	return evs
+}
+
+// apply a change event, false if it does not follow the
+// current epoch and the ring has to be rebuilt from a snapshot
+func (r *Ring) ApplyEvent(ev Event) (bool, error) {
+	if ev.Kind != "change" || ev.Epoch != r.epoch+1 {
+		return false, nil
+	}
+	if _, err := r.apply(ev.Actor, ev.Ops); err != nil {
+		return false, err
+	}
+	r.epoch = ev.Epoch
+	return true, nil
+}
@@ -0,0 +1,173 @@
+// Lookup explanation
+// how a key hashes, where it lands between ring points,
+// and which nodes the lookup passed over and why
+
+package ring
+
+import (
+	"bptree"
+	"crypto/md5"
+	"fmt"
+	"io"
+)
+
+// explain options
+type ExplainOptions struct {
+	Op        Access
+	Neighbors int     // ring points shown each side
+	Replicas  int     // explain replica pick too, if > 0
+	C         float64 // explain load cap too, if > 0
+}
+
+// point description: position, node and vnode index
+func (r *Ring) describePoint(p uint64, node string) string {
+	vnode := -1
+	if m, ok := r.members[node]; ok {
+		for i, q := range m.points {
+			if q == p {
+				vnode = i
+				break
+			}
+		}
+	}
+	return fmt.Sprintf("%x:%s#%d", p, node, vnode)
+}
+
+// reason node can't take a lookup for op, "" if usable
+func (r *Ring) skipReason(name string, op Access) string {
+	if r.health.isDown(name) {
+		return "down"
+	}
+	switch r.members[name].State {
+	case StateJoining:
+		if op == Read {
+			return "joining"
+		}
+	case StateDraining:
+		if op == Write {
+			return "draining"
+		}
+	}
+	return ""
+}
+
+// print explanation of lookup of key
+func (r *Ring) Explain(w io.Writer, key string, o ExplainOptions) {
+	digest := md5.Sum([]byte(key))
+	pos := HashKey(key)
+	fmt.Fprintf(w, "key:%s\nhasher:md5\ndigest:%x\nposition:%x\nalgorithm:%s\n", key, digest, pos, r.algo)
+	switch r.algo {
+	case AlgoMaglev:
+		r.explainMaglev(w, pos, o)
+	case AlgoMultiprobe:
+		r.explainProbes(w, pos, o)
+	default:
+		r.explainTree(w, pos, o)
+	}
+}
+
+// neighbours, wrap and skips of a successor walk
+func (r *Ring) explainTree(w io.Writer, pos uint64, o ExplainOptions) {
+	if r.tree.Len() == 0 {
+		fmt.Fprintf(w, "node:\n")
+		return
+	}
+	var before, after []string
+	r.tree.WalkBack(bptree.Item(pos), func(k bptree.Item, v string) bool {
+		before = append([]string{r.describePoint(uint64(k), v)}, before...)
+		return len(before) < o.Neighbors
+	})
+	r.tree.Walk(bptree.Item(pos), func(k bptree.Item, v string) bool {
+		after = append(after, r.describePoint(uint64(k), v))
+		return len(after) < o.Neighbors
+	})
+	fmt.Fprintf(w, "before:%s\nafter:%s\n", before, after)
+
+	// successor walk, with load cap if asked
+	limit := 0
+	if o.C > 0 {
+		limit = r.loads.capacity(o.C, len(r.members))
+		fmt.Fprintf(w, "loadcap:%d\n", limit)
+	}
+	var skipped []string
+	var owner string
+	var at uint64
+	r.tree.Walk(bptree.Item(pos), func(k bptree.Item, v string) bool {
+		reason := r.skipReason(v, o.Op)
+		if reason == "" && limit > 0 && r.loads.load[v] >= limit {
+			reason = "load cap"
+		}
+		if reason != "" {
+			skipped = append(skipped, r.describePoint(uint64(k), v)+"("+reason+")")
+			return true
+		}
+		owner, at = v, uint64(k)
+		return false
+	})
+	fmt.Fprintf(w, "skipped:%s\n", skipped)
+	if owner != "" {
+		fmt.Fprintf(w, "wrapped:%t\npoint:%s\n", at <= pos, r.describePoint(at, owner))
+	}
+	fmt.Fprintf(w, "node:%s\n", owner)
+	r.explainReplicas(w, pos, o)
+}
+
+// each probe with its successor and distance
+func (r *Ring) explainProbes(w io.Writer, pos uint64, o ExplainOptions) {
+	for i := 0; i < r.probes; i++ {
+		h := probeKey(pos, i)
+		p, node, ok := r.successor(h, o.Op)
+		if !ok {
+			break
+		}
+		fmt.Fprintf(w, "probe:%d position:%x point:%s distance:%x wrapped:%t\n",
+			i, h, r.describePoint(p, node), p-h, p <= h)
+	}
+	fmt.Fprintf(w, "node:%s\n", r.probe(pos, o.Op))
+	r.explainReplicas(w, pos, o)
+}
+
+// table slot and skipped entries
+func (r *Ring) explainMaglev(w io.Writer, pos uint64, o ExplainOptions) {
+	t := r.table
+	if t.entry == nil {
+		fmt.Fprintf(w, "node:\n")
+		return
+	}
+	idx := int(pos % uint64(t.size))
+	fmt.Fprintf(w, "table:%d slot:%d\n", t.size, idx)
+	var skipped []string
+	for i := 0; i < t.size; i++ {
+		slot := (idx + i) % t.size
+		node := t.nodes[t.entry[slot]]
+		if reason := r.skipReason(node, o.Op); reason != "" {
+			skipped = append(skipped, fmt.Sprintf("%d:%s(%s)", slot, node, reason))
+			continue
+		}
+		fmt.Fprintf(w, "skipped:%s\nnode:%s\n", skipped, node)
+		return
+	}
+	fmt.Fprintf(w, "skipped:%s\nnode:\n", skipped)
+}
+
+// replica pick with nodes passed over
+func (r *Ring) explainReplicas(w io.Writer, pos uint64, o ExplainOptions) {
+	if o.Replicas <= 0 {
+		return
+	}
+	reasons := make(map[string]string)
+	picked, _ := r.pickReplicas(pos, o.Replicas, o.Op, func(name, reason string) {
+		reasons[name] = reason
+	})
+	chosen := make(map[string]bool)
+	for _, name := range picked {
+		chosen[name] = true
+	}
+	var passed []string
+	for _, m := range r.walkNodes(pos, o.Op) {
+		if reason, ok := reasons[m.Name]; ok && !chosen[m.Name] {
+			passed = append(passed, fmt.Sprintf("%s(%s %s)", m.Name, reason, m.rackID()))
+		}
+	}
+	fmt.Fprintf(w, "replicas:%s\nreplica skipped:%s\n", picked, passed)
+}
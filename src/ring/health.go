@@ -0,0 +1,273 @@
+// Node health checking
+// nodes failing fall consecutive probes are marked down and skipped
+// by lookups, their points stay on the ring
+
+package ring
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	CheckNone = ""
+	CheckTCP  = "tcp"
+	CheckHTTP = "http"
+)
+
+// probe interval and thresholds
+type HealthConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Fall     int // consecutive failures to mark down
+	Rise     int // consecutive successes to mark up
+}
+
+var DefaultHealth = HealthConfig{
+	Interval: 5 * time.Second,
+	Timeout:  2 * time.Second,
+	Fall:     3,
+	Rise:     2,
+}
+
+// error if the checker cannot run with c
+func (c HealthConfig) Validate() error {
+	switch {
+	case c.Interval <= 0:
+		return errors.New("Health check interval must be positive")
+	case c.Timeout <= 0:
+		return errors.New("Health check timeout must be positive")
+	case c.Fall < 1 || c.Rise < 1:
+		return errors.New("Health check fall and rise must be positive")
+	}
+	return nil
+}
+
+// how to probe a node
+type Check struct {
+	Kind   string // tcp, http or none
+	Path   string // http: request path
+	Status int    // http: expected status
+}
+
+// probed node
+type healthTarget struct {
+	addr  string
+	check Check
+	down  bool
+	fails int
+	oks   int
+	err   error // last probe error
+}
+
+// periodic prober of registered nodes
+type healthChecker struct {
+	cfg     HealthConfig
+	client  *http.Client
+	mu      sync.Mutex
+	targets map[string]*healthTarget
+	stop    chan struct{}
+}
+
+// parse health check query parameters
+// check=tcp|http&path=/health&status=200
+func ParseCheck(kind, path, status string) (Check, error) {
+	c := Check{Kind: kind, Path: path, Status: http.StatusOK}
+	switch kind {
+	case CheckNone, CheckTCP:
+	case CheckHTTP:
+		if c.Path == "" {
+			c.Path = "/"
+		}
+		if status != "" {
+			s, err := strconv.Atoi(status)
+			if err != nil {
+				return c, errors.New("Invalid status " + status)
+			}
+			c.Status = s
+		}
+	default:
+		return c, errors.New("Unknown check " + kind)
+	}
+	return c, nil
+}
+
+func newHealthChecker(cfg HealthConfig) *healthChecker {
+	return &healthChecker{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		targets: make(map[string]*healthTarget),
+		stop:    make(chan struct{}),
+	}
+}
+
+// probe all targets every Interval until closed
+func (hc *healthChecker) start() {
+	go func() {
+		t := time.NewTicker(hc.cfg.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				hc.probeAll()
+			case <-hc.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (hc *healthChecker) close() {
+	close(hc.stop)
+}
+
+// start probing nodes with a health check
+func (r *Ring) Start() {
+	r.health.start()
+}
+
+// stop probing
+func (r *Ring) Close() {
+	r.health.close()
+}
+
+// print health check state of nodes
+func (r *Ring) PrintHealth(w io.Writer) {
+	r.health.print(w)
+}
+
+// register node, replaces a different previous check
+// an unchanged check keeps its state, so a down node stays down
+func (hc *healthChecker) register(name, addr string, check Check) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if check.Kind == CheckNone {
+		delete(hc.targets, name)
+		return
+	}
+	if t, ok := hc.targets[name]; ok && t.addr == addr && t.check == check {
+		return
+	}
+	hc.targets[name] = &healthTarget{addr: addr, check: check}
+}
+
+func (hc *healthChecker) unregister(name string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	delete(hc.targets, name)
+}
+
+// node marked down, unchecked nodes are always up
+func (hc *healthChecker) isDown(name string) bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	t, ok := hc.targets[name]
+	return ok && t.down
+}
+
+// one probe round over all targets
+func (hc *healthChecker) probeAll() {
+	hc.mu.Lock()
+	probes := make(map[string]healthTarget, len(hc.targets))
+	for name, t := range hc.targets {
+		probes[name] = *t
+	}
+	hc.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var rmu sync.Mutex
+	results := make(map[string]error, len(probes))
+	for name, t := range probes {
+		wg.Add(1)
+		go func(name string, t healthTarget) {
+			defer wg.Done()
+			err := hc.probe(t.addr, t.check)
+			rmu.Lock()
+			results[name] = err
+			rmu.Unlock()
+		}(name, t)
+	}
+	wg.Wait()
+
+	for name, err := range results {
+		hc.record(name, err)
+	}
+}
+
+// probe one node
+func (hc *healthChecker) probe(addr string, check Check) error {
+	switch check.Kind {
+	case CheckTCP:
+		c, err := net.DialTimeout("tcp", addr, hc.cfg.Timeout)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	case CheckHTTP:
+		resp, err := hc.client.Get("http://" + addr + check.Path)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != check.Status {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+// apply probe result to fall/rise counters
+func (hc *healthChecker) record(name string, err error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	t, ok := hc.targets[name]
+	if !ok {
+		// unregistered while probing
+		return
+	}
+	t.err = err
+	if err != nil {
+		t.oks = 0
+		t.fails++
+		if t.fails >= hc.cfg.Fall {
+			t.down = true
+		}
+		return
+	}
+	t.fails = 0
+	t.oks++
+	if t.oks >= hc.cfg.Rise {
+		t.down = false
+	}
+}
+
+// print check state of every probed node
+func (hc *healthChecker) print(w io.Writer) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	names := make([]string, 0, len(hc.targets))
+	for name := range hc.targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := hc.targets[name]
+		state := "up"
+		if t.down {
+			state = "down"
+		}
+		fmt.Fprintf(w, "%s: %s %s %s fails:%d", name, t.addr, t.check.Kind, state, t.fails)
+		if t.err != nil {
+			fmt.Fprintf(w, " err:%s", t.err)
+		}
+		fmt.Fprintln(w)
+	}
+}
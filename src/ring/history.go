@@ -0,0 +1,117 @@
+// Membership change history
+// append-only log of changes, past rings rebuilt by replaying it
+
+package ring
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// one membership change, ring creation when create is set
+type change struct {
+	epoch  uint64
+	at     time.Time
+	actor  string
+	create *Options
+	ops    []Op
+}
+
+// append change at current epoch, made by who
+// create is set for the change creating the ring, its ops (if any)
+// are the membership it starts with
+// ops are copied, the history never shares the caller's slice
+func (r *Ring) record(who string, create *Options, ops ...Op) {
+	r.history = append(r.history, change{
+		epoch:  r.epoch,
+		at:     time.Now().UTC(),
+		actor:  who,
+		create: create,
+		ops:    append([]Op(nil), ops...),
+	})
+}
+
+// epoch of the ring at time t
+func (r *Ring) EpochAt(t time.Time) (uint64, error) {
+	var e uint64
+	found := false
+	for _, c := range r.history {
+		if c.at.After(t) {
+			break
+		}
+		e, found = c.epoch, true
+	}
+	if !found {
+		return 0, errors.New("No ring at " + t.Format(time.RFC3339))
+	}
+	return e, nil
+}
+
+// ring as it was at epoch, rebuilt from the last create before it
+// health and loads are not part of the history
+func (r *Ring) At(epoch uint64) (*Ring, error) {
+	if epoch == r.epoch {
+		return r, nil
+	}
+	if epoch > r.epoch {
+		return nil, fmt.Errorf("Future epoch %d", epoch)
+	}
+	start := -1
+	for i, c := range r.history {
+		if c.epoch > epoch {
+			break
+		}
+		if c.create != nil {
+			start = i
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("No ring at epoch %d", epoch)
+	}
+	v, err := New(*r.history[start].create)
+	if err != nil {
+		return nil, err
+	}
+	end := start
+	for _, c := range r.history[start:] {
+		if c.epoch > epoch {
+			break
+		}
+		if len(c.ops) > 0 {
+			if _, err := v.Apply(c.ops); err != nil {
+				return nil, fmt.Errorf("Replay epoch %d: %s", c.epoch, err)
+			}
+		}
+		v.epoch = c.epoch
+		end++
+	}
+	// the past ring's history is a prefix of this one's,
+	// shared read only: appends to either copy
+	v.history = r.history[:end:end]
+	return v, nil
+}
+
+// print history, optionally from epoch since
+func (r *Ring) PrintHistory(w io.Writer, since uint64) {
+	for _, c := range r.history {
+		if c.epoch < since {
+			continue
+		}
+		fmt.Fprintf(w, "epoch:%d at:%s actor:%s", c.epoch, c.at.Format(time.RFC3339), c.actor)
+		if c.create != nil {
+			fmt.Fprintf(w, " create algorithm=%s", c.create.Algorithm)
+			switch c.create.Algorithm {
+			case AlgoMaglev:
+				fmt.Fprintf(w, " table=%d", c.create.Table)
+			case AlgoMultiprobe:
+				fmt.Fprintf(w, " probes=%d", c.create.Probes)
+			}
+		}
+		for _, op := range c.ops {
+			fmt.Fprintf(w, " %s", op)
+		}
+		fmt.Fprintln(w)
+	}
+}
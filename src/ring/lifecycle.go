@@ -0,0 +1,111 @@
+// Node lifecycle states
+// joining: takes writes, not primary for reads
+// active: takes reads and writes
+// draining: serves reads of existing ranges, no new placements
+// removed: points dropped from the ring
+
+package ring
+
+import "errors"
+
+const (
+	StateJoining  = "joining"
+	StateActive   = "active"
+	StateDraining = "draining"
+	StateRemoved  = "removed"
+)
+
+// lookup purpose
+type Access int
+
+const (
+	Read Access = iota
+	Write
+)
+
+// parse lookup op, read or write, default read
+func ParseAccess(s string) (Access, error) {
+	switch s {
+	case "", "read":
+		return Read, nil
+	case "write":
+		return Write, nil
+	}
+	return Read, errors.New("Invalid op " + s)
+}
+
+// allowed transitions
+var transitions = map[string][]string{
+	StateJoining:  {StateActive, StateRemoved},
+	StateActive:   {StateDraining},
+	StateDraining: {StateActive, StateRemoved},
+}
+
+// state of a node added with state param, default active
+func ParseInitialState(s string) (string, error) {
+	switch s {
+	case "":
+		return StateActive, nil
+	case StateJoining, StateActive:
+		return s, nil
+	}
+	return "", errors.New("Invalid initial state " + s)
+}
+
+// transition allowed
+func canTransition(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// move node to state
+func (r *Ring) SetState(name, state string) error {
+	m, ok := r.members[name]
+	if !ok {
+		return errors.New("Unknown node " + name)
+	}
+	if m.State == state {
+		return nil
+	}
+	if !canTransition(m.State, state) {
+		return errors.New("Invalid transition " + m.State + " -> " + state)
+	}
+	if state == StateRemoved {
+		r.drop(name)
+		r.commit()
+	} else {
+		m.State = state
+		r.epoch++
+	}
+	r.record(r.actor, nil, Op{Op: "state", Node: name, State: state})
+	return nil
+}
+
+// state of node, removed if not on the ring
+func (r *Ring) NodeState(name string) string {
+	if name == "" {
+		return ""
+	}
+	if m, ok := r.members[name]; ok {
+		return m.State
+	}
+	return StateRemoved
+}
+
+// node may serve a lookup for op
+func (r *Ring) usable(name string, op Access) bool {
+	if r.health.isDown(name) {
+		return false
+	}
+	switch r.members[name].State {
+	case StateJoining:
+		return op == Write
+	case StateDraining:
+		return op == Read
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+// Batch lookup
+// large batches on the bptree ring sort the key hashes and
+// sweep the ring points once instead of one descent per key
+
+package ring
+
+import (
+	"bptree"
+	"sort"
+)
+
+// batches at least this big are swept
+const sweepBatch = 64
+
+// one located key
+type Located struct {
+	Key      string   `json:"key"`
+	Node     string   `json:"node"`
+	Replicas []string `json:"replicas,omitempty"`
+}
+
+// owners of keys for op, and n replicas each if n > 0
+func (r *Ring) LocateAll(keys []string, op Access, n int) ([]Located, error) {
+	out := make([]Located, len(keys))
+	hashes := make([]uint64, len(keys))
+	for i, k := range keys {
+		out[i].Key = k
+		hashes[i] = HashKey(k)
+	}
+	if r.algo == AlgoBptree && len(keys) >= sweepBatch {
+		r.sweep(hashes, op, out)
+	} else {
+		for i, h := range hashes {
+			out[i].Node = r.locate(h, op)
+		}
+	}
+	if n > 0 {
+		for i, h := range hashes {
+			rs, err := r.pickReplicas(h, n, op, nil)
+			if err != nil {
+				return nil, err
+			}
+			out[i].Replicas = rs
+		}
+	}
+	return out, nil
+}
+
+// successor of every hash in one pass over the points
+// points of nodes unusable for op are left out
+func (r *Ring) sweep(hashes []uint64, op Access, out []Located) {
+	var pts []point
+	r.tree.Ascend(func(k bptree.Item, v string) bool {
+		if r.usable(v, op) {
+			pts = append(pts, point{uint64(k), v})
+		}
+		return true
+	})
+	if len(pts) == 0 {
+		return
+	}
+	order := make([]int, len(hashes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return hashes[order[a]] < hashes[order[b]] })
+	j := 0
+	for _, i := range order {
+		// first point strictly greater, wrapping to the first
+		for j < len(pts) && pts[j].key <= hashes[i] {
+			j++
+		}
+		if j == len(pts) {
+			out[i].Node = pts[0].node
+		} else {
+			out[i].Node = pts[j].node
+		}
+	}
+}
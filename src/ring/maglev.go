@@ -0,0 +1,124 @@
+// Maglev lookup table (Eisenbud et al, NSDI 2016)
+// each node fills a prime sized table following its own permutation
+
+package ring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+const (
+	DefaultTableSize = 65537
+	// the table is rebuilt on every change, under the ring's lock
+	MaxTableSize = 1 << 22
+)
+
+// lookup table, entry is index into nodes
+type maglevTable struct {
+	size  int
+	nodes []string
+	entry []int
+}
+
+// create empty table of prime size
+func newMaglevTable(size int) (*maglevTable, error) {
+	if size < 2 || !big.NewInt(int64(size)).ProbablyPrime(0) {
+		return nil, errors.New("Table size must be prime")
+	}
+	return &maglevTable{size: size}, nil
+}
+
+// offset,skip of a node's permutation
+// from the two halves of md5(name)
+func (t *maglevTable) permutation(name string) (uint64, uint64) {
+	sum := md5.Sum([]byte(name))
+	offset := binary.BigEndian.Uint64(sum[0:8]) % uint64(t.size)
+	skip := binary.BigEndian.Uint64(sum[8:16])%uint64(t.size-1) + 1
+	return offset, skip
+}
+
+// rebuild table from members, names sorted
+// a node with weight w claims w entries per round
+// returns number of entries whose owner changed
+func (t *maglevTable) build(members map[string]*member, names []string) int {
+	prev := t.nodes
+	prevEntry := t.entry
+	t.nodes = names
+	t.entry = nil
+	if len(names) == 0 {
+		return len(prevEntry)
+	}
+
+	offset := make([]uint64, len(names))
+	skip := make([]uint64, len(names))
+	next := make([]uint64, len(names))
+	for i, name := range names {
+		offset[i], skip[i] = t.permutation(name)
+	}
+	entry := make([]int, t.size)
+	for i := range entry {
+		entry[i] = -1
+	}
+	filled := 0
+	for filled < t.size {
+		for i, name := range names {
+			for w := 0; w < members[name].Weight && filled < t.size; w++ {
+				// next unclaimed slot in node's permutation
+				c := (offset[i] + next[i]*skip[i]) % uint64(t.size)
+				for entry[c] >= 0 {
+					next[i]++
+					c = (offset[i] + next[i]*skip[i]) % uint64(t.size)
+				}
+				entry[c] = i
+				next[i]++
+				filled++
+			}
+		}
+	}
+	t.entry = entry
+
+	// count entries that moved, all of them after an empty table
+	if prevEntry == nil {
+		return len(entry)
+	}
+	moved := 0
+	for i := range entry {
+		if prev[prevEntry[i]] != names[entry[i]] {
+			moved++
+		}
+	}
+	return moved
+}
+
+// node owning key
+// down nodes are skipped by probing the following entries
+func (t *maglevTable) lookup(key uint64, down func(string) bool) string {
+	if t.entry == nil {
+		return ""
+	}
+	idx := int(key % uint64(t.size))
+	for i := 0; i < t.size; i++ {
+		node := t.nodes[t.entry[(idx+i)%t.size]]
+		if !down(node) {
+			return node
+		}
+	}
+	return ""
+}
+
+// print table size and entries per node
+func (t *maglevTable) print(w io.Writer) {
+	fmt.Fprintf(w, "Maglev table:%d\n", t.size)
+	count := make([]int, len(t.nodes))
+	for _, e := range t.entry {
+		count[e]++
+	}
+	for i, name := range t.nodes {
+		fmt.Fprintf(w, "%s: %d\n", name, count[i])
+	}
+}
@@ -0,0 +1,47 @@
+// Multi-probe consistent hashing (Appleton & O'Reilly, 2015)
+// one point per node, key hashed k times, closest successor wins
+
+package ring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+)
+
+const (
+	DefaultProbes = 21
+	// every lookup hashes each probe, keep them cheap
+	MaxProbes = 1024
+)
+
+// position of probe i for key
+// probe 0 is the key itself
+func probeKey(key uint64, i int) uint64 {
+	if i == 0 {
+		return key
+	}
+	var b [12]byte
+	binary.BigEndian.PutUint64(b[0:8], key)
+	binary.BigEndian.PutUint32(b[8:12], uint32(i))
+	sum := md5.Sum(b[:])
+	return binary.BigEndian.Uint64(sum[0:8])
+}
+
+// node whose point is the nearest successor of any probe
+func (r *Ring) probe(key uint64, op Access) string {
+	best := ""
+	var bestDist uint64
+	for i := 0; i < r.probes; i++ {
+		h := probeKey(key, i)
+		p, node, ok := r.successor(h, op)
+		if !ok {
+			return ""
+		}
+		// clockwise distance, wraps mod 2^64
+		dist := p - h
+		if best == "" || dist < bestDist {
+			best, bestDist = node, dist
+		}
+	}
+	return best
+}
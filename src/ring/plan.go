@@ -0,0 +1,153 @@
+// Rebalance plan
+// diff ownership of the current ring against the ring after a
+// proposed change, as hash ranges moving between nodes
+
+package ring
+
+import (
+	"bptree"
+	"fmt"
+	"io"
+	"math"
+)
+
+// hash interval [start, end) on the 2^64 circle owned by node
+// start > end wraps past max key, start == end is the whole circle
+type hashRange struct {
+	start uint64
+	end   uint64
+	node  string
+}
+
+// fraction of 2^64 keyspace
+func (hr hashRange) fraction() float64 {
+	if hr.start == hr.end {
+		return 1
+	}
+	return float64(hr.end-hr.start) / math.Exp2(64)
+}
+
+// range moving from one node to another
+type move struct {
+	hashRange
+	from string
+}
+
+// ring points in key order
+type point struct {
+	key  uint64
+	node string
+}
+
+func treePoints(t *bptree.Bptree) []point {
+	pts := make([]point, 0, t.Len())
+	t.Ascend(func(k bptree.Item, v string) bool {
+		pts = append(pts, point{uint64(k), v})
+		return true
+	})
+	return pts
+}
+
+// owner of keys just below e: node of first point >= e, wrapping
+// i is a cursor into pts, advanced past points below e
+func ownerAt(pts []point, i *int, e uint64) string {
+	for *i < len(pts) && pts[*i].key < e {
+		*i++
+	}
+	if *i == len(pts) {
+		return pts[0].node
+	}
+	return pts[*i].node
+}
+
+// ranges whose owner differs between two trees
+// sweeps the union of both trees' points in key order
+// an empty tree owns nothing, its side of every move is ""
+func diffTrees(old, cur *bptree.Bptree) []move {
+	a, b := treePoints(old), treePoints(cur)
+	if len(a) == 0 || len(b) == 0 {
+		var moves []move
+		for _, hr := range ownedRanges(cur) {
+			moves = append(moves, move{hr, ""})
+		}
+		for _, hr := range ownedRanges(old) {
+			moves = append(moves, move{hashRange{hr.start, hr.end, ""}, hr.node})
+		}
+		return moves
+	}
+	// merge boundaries
+	bounds := make([]uint64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i].key < b[j].key):
+			bounds = append(bounds, a[i].key)
+			i++
+		case i == len(a) || b[j].key < a[i].key:
+			bounds = append(bounds, b[j].key)
+			j++
+		default:
+			bounds = append(bounds, a[i].key)
+			i++
+			j++
+		}
+	}
+
+	// segment ending at bounds[k] starts at bounds[k-1],
+	// the first segment wraps from the last bound
+	var moves []move
+	ai, bi := 0, 0
+	for k, e := range bounds {
+		s := bounds[(k+len(bounds)-1)%len(bounds)]
+		from, to := ownerAt(a, &ai, e), ownerAt(b, &bi, e)
+		if from == to {
+			continue
+		}
+		// extend previous move if contiguous
+		if n := len(moves); n > 0 && moves[n-1].end == s && moves[n-1].from == from && moves[n-1].node == to {
+			moves[n-1].end = e
+			continue
+		}
+		moves = append(moves, move{hashRange{s, e, to}, from})
+	}
+	// join wrapping segment with the one after it
+	if n := len(moves); n > 1 && moves[n-1].end == moves[0].start &&
+		moves[n-1].from == moves[0].from && moves[n-1].node == moves[0].node {
+		moves[0].start = moves[n-1].start
+		moves = moves[:n-1]
+	}
+	return moves
+}
+
+// ring after applying ops, current ring untouched
+func (r *Ring) whatIf(ops []Op) (*Ring, int, error) {
+	c := r.Clone()
+	moved, err := c.Apply(ops)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c, moved, nil
+}
+
+// print moves of the plan for ops
+func (r *Ring) Plan(w io.Writer, ops []Op) error {
+	if r.algo == AlgoMultiprobe {
+		return fmt.Errorf("Not supported by %s ring", r.algo)
+	}
+	next, moved, err := r.whatIf(ops)
+	if err != nil {
+		return err
+	}
+	if r.algo == AlgoMaglev {
+		fmt.Fprintf(w, "moved:%d/%d fraction:%.6f\n", moved, r.table.size, float64(moved)/float64(r.table.size))
+		return nil
+	}
+	total := 0.0
+	for _, mv := range diffTrees(r.tree, next.tree) {
+		f := mv.fraction()
+		total += f
+		fmt.Fprintf(w, "range:[%x,%x) from:%s to:%s fraction:%.6f\n", mv.start, mv.end, mv.from, mv.node, f)
+	}
+	fmt.Fprintf(w, "moved fraction:%.6f\n", total)
+	return nil
+}
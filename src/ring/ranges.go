@@ -0,0 +1,59 @@
+// Ownership ranges
+// point p owns the keys from the previous point up to p
+
+package ring
+
+import (
+	"bptree"
+	"fmt"
+	"io"
+)
+
+// contiguous ranges in key order, the first one wraps from the last point
+func ownedRanges(t *bptree.Bptree) []hashRange {
+	pts := treePoints(t)
+	if len(pts) == 0 {
+		return nil
+	}
+	var rs []hashRange
+	prev := pts[len(pts)-1].key
+	for _, p := range pts {
+		if n := len(rs); n > 0 && rs[n-1].node == p.node {
+			rs[n-1].end = p.key
+		} else {
+			rs = append(rs, hashRange{prev, p.key, p.node})
+		}
+		prev = p.key
+	}
+	// last range continues into the wrapping first one
+	if n := len(rs); n > 1 && rs[n-1].node == rs[0].node {
+		rs[0].start = rs[n-1].start
+		rs = rs[:n-1]
+	}
+	return rs
+}
+
+// print ranges of node, all nodes if name is empty
+func (r *Ring) PrintRanges(w io.Writer, name string) error {
+	if r.tree == nil || r.algo == AlgoMultiprobe {
+		return fmt.Errorf("Not supported by %s ring", r.algo)
+	}
+	if name != "" {
+		if _, ok := r.members[name]; !ok {
+			return fmt.Errorf("Unknown node %s", name)
+		}
+	}
+	total := 0.0
+	for _, hr := range ownedRanges(r.tree) {
+		if name != "" && hr.node != name {
+			continue
+		}
+		f := hr.fraction()
+		total += f
+		fmt.Fprintf(w, "range:[%x,%x) node:%s fraction:%.6f\n", hr.start, hr.end, hr.node, f)
+	}
+	if name != "" {
+		fmt.Fprintf(w, "node:%s fraction:%.6f\n", name, total)
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+// Consistent hash ring, embeddable
+// bptree ring: node points on a B+ tree, successor lookup
+// multiprobe ring: one point per node, k probes per key
+// maglev ring: prime sized lookup table, O(1) lookup
+//
+// a Ring is not safe for concurrent use, callers serialize
+// changes against lookups
+
+package ring
+
+import (
+	"bptree"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+const (
+	AlgoBptree     = "bptree"
+	AlgoMultiprobe = "multiprobe"
+	AlgoMaglev     = "maglev"
+)
+
+// ring creation options
+type Options struct {
+	Algorithm string
+	Table     int // maglev
+	Probes    int // multiprobe
+	Health    HealthConfig
+	Actor     string // who the create and, until SetActor, changes are recorded as made by
+}
+
+// physical node
+type Node struct {
+	Name   string
+	Weight int
+	State  string
+	Region string
+	Zone   string
+	Rack   string
+	Addr   string
+	Check  Check
+}
+
+// node on the ring
+type member struct {
+	Node
+	points []uint64 // ring points (bptree ring only)
+}
+
+// the ring
+type Ring struct {
+	algo    string
+	epoch   uint64 // bumped on every membership change
+	probes  int
+	tree    *bptree.Bptree
+	table   *maglevTable
+	members map[string]*member
+	loads   *loadTracker
+	health  *healthChecker
+	history []change
+	actor   string // recorded with changes
+}
+
+// 64-bit ring position: md5 prefix, big endian
+func HashKey(s string) uint64 {
+	kmd5 := md5.Sum([]byte(s))
+	var key uint64
+	_ = binary.Read(bytes.NewReader(kmd5[0:8]), binary.BigEndian, &key)
+	return key
+}
+
+// name of vnode i of a node
+// vnode 0 is the node name itself
+func vnodeName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + "#" + strconv.Itoa(i)
+}
+
+// create a ring, bptree if no algorithm is given
+// the create is the first entry of the ring's history
+// health checker is started by Start
+func New(opts Options) (*Ring, error) {
+	if opts.Algorithm == "" {
+		opts.Algorithm = AlgoBptree
+	}
+	if opts.Table == 0 {
+		opts.Table = DefaultTableSize
+	}
+	if opts.Probes == 0 {
+		opts.Probes = DefaultProbes
+	}
+	if opts.Health.Interval == 0 {
+		opts.Health = DefaultHealth
+	}
+	if err := opts.Health.Validate(); err != nil {
+		return nil, err
+	}
+	r := &Ring{algo: opts.Algorithm, members: make(map[string]*member), loads: newLoadTracker()}
+	switch opts.Algorithm {
+	case AlgoBptree, AlgoMultiprobe:
+		t, err := bptree.New(3)
+		if err != nil {
+			return nil, err
+		}
+		r.tree = t
+	case AlgoMaglev:
+		if opts.Table > MaxTableSize {
+			return nil, errors.New("Table size must be at most " + strconv.Itoa(MaxTableSize))
+		}
+		t, err := newMaglevTable(opts.Table)
+		if err != nil {
+			return nil, err
+		}
+		r.table = t
+	default:
+		return nil, errors.New("Unknown algorithm " + opts.Algorithm)
+	}
+	if opts.Algorithm == AlgoMultiprobe {
+		if opts.Probes < 1 || opts.Probes > MaxProbes {
+			return nil, errors.New("Probes must be 1 to " + strconv.Itoa(MaxProbes))
+		}
+		r.probes = opts.Probes
+	}
+	r.health = newHealthChecker(opts.Health)
+	r.actor = opts.Actor
+	r.record(opts.Actor, &opts)
+	return r, nil
+}
+
+// take over epoch and history of the ring this one replaces,
+// epochs stay monotonic across re-creation
+// r must be fresh from New, its create is recorded after prev's history
+func (r *Ring) Follow(prev *Ring) {
+	r.StartAt(prev.epoch + 1)
+	n := len(prev.history)
+	r.history = append(prev.history[:n:n], r.history[len(r.history)-1])
+}
+
+// start the epochs of r, fresh from New, at epoch,
+// for a ring replacing one whose history is gone
+func (r *Ring) StartAt(epoch uint64) {
+	r.epoch = epoch
+	r.history[len(r.history)-1].epoch = epoch
+}
+
+// record later changes as made by who
+func (r *Ring) SetActor(who string) {
+	r.actor = who
+}
+
+// copy of the membership for what-if changes
+// shares tree nodes copy-on-write, no health probing or loads
+func (r *Ring) Clone() *Ring {
+	c := &Ring{
+		algo:    r.algo,
+		epoch:   r.epoch,
+		probes:  r.probes,
+		members: make(map[string]*member, len(r.members)),
+		loads:   newLoadTracker(),
+		health:  newHealthChecker(r.health.cfg),
+	}
+	for name, m := range r.members {
+		cm := *m
+		cm.points = append([]uint64(nil), m.points...)
+		c.members[name] = &cm
+		c.health.register(name, cm.Addr, cm.Check)
+	}
+	if r.tree != nil {
+		c.tree = r.tree.Clone()
+	}
+	if r.table != nil {
+		t := *r.table
+		c.table = &t
+	}
+	return c
+}
+
+// ring algorithm
+func (r *Ring) Algorithm() string {
+	return r.algo
+}
+
+// current epoch
+func (r *Ring) Epoch() uint64 {
+	return r.epoch
+}
+
+// maglev table size, 0 for other rings
+func (r *Ring) TableSize() int {
+	if r.table == nil {
+		return 0
+	}
+	return r.table.size
+}
+
+// sorted member names
+func (r *Ring) names() []string {
+	names := make([]string, 0, len(r.members))
+	for name := range r.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// nodes sorted by name
+func (r *Ring) Nodes() []Node {
+	nodes := make([]Node, 0, len(r.members))
+	for _, name := range r.names() {
+		nodes = append(nodes, r.members[name].Node)
+	}
+	return nodes
+}
+
+// node by name
+func (r *Ring) Node(name string) (Node, bool) {
+	m, ok := r.members[name]
+	if !ok {
+		return Node{}, false
+	}
+	return m.Node, true
+}
+
+// add node (or change its weight, labels, check)
+// an empty state is active for a new node, unchanged for a present one
+// returns number of maglev table entries moved
+func (r *Ring) Add(n Node) (int, error) {
+	moved, err := r.Apply([]Op{AddOp(n)})
+	if oe, ok := err.(*opError); ok {
+		// a single change, no op to point at
+		return 0, oe.err
+	}
+	return moved, err
+}
+
+// remove node
+// returns number of maglev table entries moved
+func (r *Ring) Remove(name string) (bool, int) {
+	if !r.drop(name) {
+		return false, 0
+	}
+	moved := r.commit()
+	r.record(r.actor, nil, Op{Op: "remove", Node: name})
+	return true, moved
+}
+
+// place member on the ring, table rebuilt by commit
+func (r *Ring) put(m *member) {
+	if m.Weight < 1 || r.algo == AlgoMultiprobe {
+		m.Weight = 1
+	}
+	if old, ok := r.members[m.Name]; ok {
+		r.removePoints(old)
+	}
+	r.members[m.Name] = m
+	r.health.register(m.Name, m.Addr, m.Check)
+	if r.tree == nil {
+		return
+	}
+	for i := 0; i < m.Weight; i++ {
+		p := HashKey(vnodeName(m.Name, i))
+		r.tree.Insert(bptree.Item(p), m.Name)
+		m.points = append(m.points, p)
+	}
+}
+
+// take member off the ring, table rebuilt by commit
+func (r *Ring) drop(name string) bool {
+	m, ok := r.members[name]
+	if !ok {
+		return false
+	}
+	r.removePoints(m)
+	delete(r.members, name)
+	r.loads.dropNode(name)
+	r.health.unregister(name)
+	return true
+}
+
+// finish a membership change: rebuild table, bump epoch
+// returns number of maglev table entries moved
+func (r *Ring) commit() int {
+	r.epoch++
+	if r.algo == AlgoMaglev {
+		return r.table.build(r.members, r.names())
+	}
+	return 0
+}
+
+// remove points of a node from the tree
+func (r *Ring) removePoints(m *member) {
+	for _, p := range m.points {
+		r.tree.Del(bptree.Item(p))
+	}
+	m.points = nil
+}
+
+// first point of a node usable for op clockwise after key
+func (r *Ring) successor(key uint64, op Access) (uint64, string, bool) {
+	var p uint64
+	var node string
+	found := false
+	r.tree.Walk(bptree.Item(key), func(k bptree.Item, v string) bool {
+		if !r.usable(v, op) {
+			return true
+		}
+		p, node, found = uint64(k), v, true
+		return false
+	})
+	return p, node, found
+}
+
+// node owning ring position key for op
+func (r *Ring) locate(key uint64, op Access) string {
+	switch r.algo {
+	case AlgoMaglev:
+		return r.table.lookup(key, func(name string) bool {
+			return !r.usable(name, op)
+		})
+	case AlgoMultiprobe:
+		return r.probe(key, op)
+	default:
+		_, node, _ := r.successor(key, op)
+		return node
+	}
+}
+
+// node owning key for op, "" if none can take it
+func (r *Ring) Locate(key string, op Access) string {
+	return r.locate(HashKey(key), op)
+}
+
+// node of the point at ring position key
+func (r *Ring) Point(key uint64) (string, error) {
+	if r.tree == nil {
+		return "", errors.New("Not supported by " + r.algo + " ring")
+	}
+	return r.tree.Get(bptree.Item(key)), nil
+}
+
+// nodes of the n points after ring position key
+func (r *Ring) NextPoints(key uint64, n int) ([]string, error) {
+	if r.tree == nil {
+		return nil, errors.New("Not supported by " + r.algo + " ring")
+	}
+	return r.tree.GetNextN(bptree.Item(key), n), nil
+}
+
+// print ring
+func (r *Ring) Print(w io.Writer) {
+	switch r.algo {
+	case AlgoMaglev:
+		r.table.print(w)
+	case AlgoMultiprobe:
+		fmt.Fprintf(w, "Probes:%d\n", r.probes)
+		r.tree.Print(w)
+	default:
+		r.tree.Print(w)
+	}
+}
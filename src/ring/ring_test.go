@@ -0,0 +1,239 @@
+package ring_test
+
+import (
+	"ring"
+	"strings"
+	"testing"
+)
+
+func newRing(t *testing.T, o ring.Options) *ring.Ring {
+	t.Helper()
+	r, err := ring.New(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestTableSizeLimit(t *testing.T) {
+	for _, size := range []int{2147483647, ring.MaxTableSize + 1} {
+		if _, err := ring.New(ring.Options{Algorithm: ring.AlgoMaglev, Table: size}); err == nil || !strings.HasPrefix(err.Error(), "Table size must be at most") {
+			t.Errorf("table %d: %v", size, err)
+		}
+	}
+	if _, err := ring.New(ring.Options{Algorithm: ring.AlgoMaglev, Table: 4194301}); err != nil {
+		t.Errorf("largest prime table: %s", err)
+	}
+}
+
+func TestWeightLimit(t *testing.T) {
+	r := newRing(t, ring.Options{})
+	if _, err := r.Add(ring.Node{Name: "a", Weight: ring.MaxWeight}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(ring.Node{Name: "b", Weight: 100000000}); err == nil {
+		t.Errorf("weight 1e8 accepted")
+	}
+	if _, err := r.Apply([]ring.Op{{Op: "weight", Node: "a", Weight: ring.MaxWeight + 1}}); err == nil {
+		t.Errorf("weight op over the limit accepted")
+	}
+	s := r.Snapshot()
+	s.Nodes[0].Weight = ring.MaxWeight + 1
+	if _, err := ring.FromSnapshot(s); err == nil {
+		t.Errorf("snapshot weight over the limit accepted")
+	}
+	if n, _ := r.Node("a"); n.Weight != ring.MaxWeight || r.Epoch() != 1 {
+		t.Errorf("rejected changes applied: %+v epoch %d", n, r.Epoch())
+	}
+}
+
+func names(nodes []ring.Node) string {
+	var s []string
+	for _, n := range nodes {
+		s = append(s, n.Name+":"+n.State)
+	}
+	return strings.Join(s, " ")
+}
+
+func at(t *testing.T, r *ring.Ring, epoch uint64) string {
+	t.Helper()
+	v, err := r.At(epoch)
+	if err != nil {
+		t.Fatalf("At(%d): %s", epoch, err)
+	}
+	if v.Epoch() != epoch {
+		t.Fatalf("At(%d) is at epoch %d", epoch, v.Epoch())
+	}
+	return names(v.Nodes())
+}
+
+// a ring used in process keeps its own history
+func TestEmbeddedHistory(t *testing.T) {
+	r := newRing(t, ring.Options{Actor: "app"})
+	if _, err := r.Add(ring.Node{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(ring.Node{Name: "b", Zone: "z2"}); err != nil {
+		t.Fatal(err)
+	}
+	r.SetActor("ops")
+	if err := r.SetState("a", ring.StateDraining); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := r.Remove("b"); !found {
+		t.Fatal("b not removed")
+	}
+	if err := r.SetState("a", ring.StateRemoved); err != nil {
+		t.Fatal(err)
+	}
+	if r.Epoch() != 5 {
+		t.Fatalf("epoch %d", r.Epoch())
+	}
+	for epoch, want := range []string{"", "a:active", "a:active b:active", "a:draining b:active", "a:draining", ""} {
+		if got := at(t, r, uint64(epoch)); got != want {
+			t.Errorf("At(%d): %q, want %q", epoch, got, want)
+		}
+	}
+	// a past ring answers for its own past too
+	if v, _ := r.At(3); names(mustAt(t, v, 1).Nodes()) != "a:active" {
+		t.Errorf("At(3).At(1) differs from At(1)")
+	}
+
+	evs := r.Events(1)
+	if len(evs) != 4 || evs[0].Kind != "change" || evs[0].Epoch != 2 || evs[0].Actor != "app" || evs[0].Ops[0].Node != "b" {
+		t.Fatalf("Events(1): %+v", evs)
+	}
+	if evs[1].Actor != "ops" || evs[1].Ops[0].Op != "state" || evs[2].Ops[0].Op != "remove" {
+		t.Errorf("Events(1): %+v", evs)
+	}
+
+	var b strings.Builder
+	r.PrintHistory(&b, 0)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 6 || !strings.HasSuffix(lines[0], "actor:app create algorithm=bptree") ||
+		!strings.HasSuffix(lines[1], "actor:app add a weight=1 state=active") ||
+		!strings.HasSuffix(lines[3], "actor:ops state a draining") ||
+		!strings.HasSuffix(lines[4], "actor:ops remove b") ||
+		!strings.HasSuffix(lines[5], "actor:ops state a removed") {
+		t.Errorf("history:\n%s", b.String())
+	}
+}
+
+func mustAt(t *testing.T, r *ring.Ring, epoch uint64) *ring.Ring {
+	t.Helper()
+	v, err := r.At(epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// replicas follow a ring through its events
+func TestApplyEvents(t *testing.T) {
+	r := newRing(t, ring.Options{})
+	replica := newRing(t, ring.Options{})
+	for _, n := range []string{"a", "b", "c"} {
+		if _, err := r.Add(ring.Node{Name: n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.SetState("b", ring.StateDraining)
+	for _, ev := range r.Events(0) {
+		if ok, err := replica.ApplyEvent(ev); !ok || err != nil {
+			t.Fatalf("ApplyEvent(%+v): %t %v", ev, ok, err)
+		}
+	}
+	if names(replica.Nodes()) != names(r.Nodes()) || replica.Epoch() != r.Epoch() {
+		t.Errorf("replica %q at %d, ring %q at %d", names(replica.Nodes()), replica.Epoch(), names(r.Nodes()), r.Epoch())
+	}
+	if got := at(t, replica, 2); got != "a:active b:active" {
+		t.Errorf("replica At(2): %q", got)
+	}
+}
+
+func TestAddErrors(t *testing.T) {
+	r := newRing(t, ring.Options{})
+	if _, err := r.Add(ring.Node{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// a single add has no op index to report
+	if _, err := r.Add(ring.Node{Name: "a", State: ring.StateJoining}); err == nil || err.Error() != "Invalid transition active -> joining" {
+		t.Errorf("Add: %v", err)
+	}
+	if _, err := r.Apply([]ring.Op{{Op: "add", Node: "b"}, {Op: "add", Node: "a", State: ring.StateJoining}}); err == nil || err.Error() != "op 1: Invalid transition active -> joining" {
+		t.Errorf("Apply: %v", err)
+	}
+	if r.Epoch() != 1 || len(r.Events(0)) != 1 {
+		t.Errorf("failed changes recorded: epoch %d events %+v", r.Epoch(), r.Events(0))
+	}
+}
+
+func TestFollow(t *testing.T) {
+	old := newRing(t, ring.Options{})
+	old.Add(ring.Node{Name: "a"})
+	r := newRing(t, ring.Options{Algorithm: ring.AlgoMaglev, Table: 7})
+	r.Follow(old)
+	r.Add(ring.Node{Name: "b"})
+	if r.Epoch() != 3 {
+		t.Fatalf("epoch %d", r.Epoch())
+	}
+	if got := at(t, r, 1); got != "a:active" {
+		t.Errorf("At(1): %q", got)
+	}
+	if got := at(t, r, 2); got != "" {
+		t.Errorf("At(2): %q", got)
+	}
+	if evs := r.Events(1); len(evs) != 1 || evs[0].Kind != "snapshot" {
+		t.Errorf("Events across re-creation: %+v", evs)
+	}
+	if evs := r.Events(2); len(evs) != 1 || evs[0].Kind != "change" {
+		t.Errorf("Events(2): %+v", evs)
+	}
+}
+
+func TestFromSnapshotHistory(t *testing.T) {
+	r := newRing(t, ring.Options{})
+	r.Add(ring.Node{Name: "a"})
+	r.Add(ring.Node{Name: "b"})
+	r.SetState("a", ring.StateDraining)
+	c, err := ring.FromSnapshot(r.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := at(t, c, 3); got != "a:draining b:active" {
+		t.Errorf("At(3): %q", got)
+	}
+	if _, err := c.At(2); err == nil {
+		t.Errorf("history before the snapshot")
+	}
+	c.Add(ring.Node{Name: "d"})
+	if evs := c.Events(3); len(evs) != 1 || evs[0].Kind != "change" || evs[0].Epoch != 4 {
+		t.Errorf("Events(3): %+v", evs)
+	}
+}
+
+// snapshot events and snapshots rebuild the same membership
+func TestSnapshotOps(t *testing.T) {
+	r := newRing(t, ring.Options{})
+	r.Add(ring.Node{Name: "a", Weight: 2, Zone: "z1"})
+	r.Add(ring.Node{Name: "b"})
+	r.SetState("a", ring.StateDraining)
+	ev := r.SnapshotEvent()
+	ops := r.Snapshot().Ops()
+	if len(ev.Ops) != 3 || len(ops) != 3 {
+		t.Fatalf("ops: %+v, %+v", ev.Ops, ops)
+	}
+	for i := range ops {
+		if ev.Ops[i] != ops[i] {
+			t.Errorf("op %d: %+v, %+v", i, ev.Ops[i], ops[i])
+		}
+	}
+	// draining is reached through active
+	if ops[0].State != ring.StateActive || ops[1].Op != "state" || ops[1].State != ring.StateDraining {
+		t.Errorf("ops: %+v", ops)
+	}
+	replica := newRing(t, ring.Options{})
+	if _, err := replica.Apply(ops); err != nil || names(replica.Nodes()) != names(r.Nodes()) {
+		t.Errorf("rebuilt %q: %v", names(replica.Nodes()), err)
+	}
+}
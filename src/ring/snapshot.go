@@ -0,0 +1,300 @@
+// Ring snapshot
+// the whole ring in one payload for client side lookups,
+// as JSON or a compact binary encoding
+
+package ring
+
+import (
+	"bptree"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	snapshotMagic   = "CHRS"
+	snapshotVersion = 2 // 2 adds health checks
+	SnapshotBinary  = "application/x-chr-snapshot"
+)
+
+// node in a snapshot
+type SnapshotNode struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+	State  string `json:"state"`
+	Region string `json:"region,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+	Rack   string `json:"rack,omitempty"`
+	Addr   string `json:"addr,omitempty"`
+	Check  string `json:"check,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// ring point, key in hex
+type SnapshotPoint struct {
+	Key  string `json:"key"`
+	Node string `json:"node"`
+}
+
+// whole ring at one epoch
+type Snapshot struct {
+	Algorithm string          `json:"algorithm"`
+	Hasher    string          `json:"hasher"`
+	Seed      uint64          `json:"seed"`
+	Epoch     uint64          `json:"epoch"`
+	Probes    int             `json:"probes,omitempty"`
+	Table     int             `json:"table,omitempty"`
+	Nodes     []SnapshotNode  `json:"nodes"`
+	Points    []SnapshotPoint `json:"points,omitempty"`  // bptree, multiprobe
+	Entries   []int           `json:"entries,omitempty"` // maglev: index into nodes
+	keys      []uint64
+}
+
+// snapshot of current ring
+func (r *Ring) Snapshot() *Snapshot {
+	s := &Snapshot{Algorithm: r.algo, Hasher: "md5", Epoch: r.epoch, Probes: r.probes, Nodes: r.snapshotNodes()}
+	idx := make(map[string]int, len(s.Nodes))
+	for i, n := range s.Nodes {
+		idx[n.Name] = i
+	}
+	if r.tree != nil {
+		r.tree.Ascend(func(k bptree.Item, v string) bool {
+			s.keys = append(s.keys, uint64(k))
+			s.Points = append(s.Points, SnapshotPoint{fmt.Sprintf("%016x", uint64(k)), v})
+			return true
+		})
+	}
+	if r.table != nil {
+		s.Table = r.table.size
+		// table node list is the sorted member list
+		for _, e := range r.table.entry {
+			s.Entries = append(s.Entries, idx[r.table.nodes[e]])
+		}
+	}
+	return s
+}
+
+// members sorted by name
+func (r *Ring) snapshotNodes() []SnapshotNode {
+	var nodes []SnapshotNode
+	for _, name := range r.names() {
+		m := r.members[name]
+		op := AddOp(m.Node)
+		nodes = append(nodes, SnapshotNode{
+			Name:   name,
+			Weight: m.Weight,
+			State:  m.State,
+			Region: m.Region,
+			Zone:   m.Zone,
+			Rack:   m.Rack,
+			Addr:   m.Addr,
+			Check:  op.Check,
+			Path:   op.Path,
+			Status: op.Status,
+		})
+	}
+	return nodes
+}
+
+// binary encoding:
+// magic, version, uvarint epoch, seed, probes, table,
+// strings algorithm, hasher (uvarint length + bytes),
+// uvarint node count, per node name, uvarint weight, state,
+// region, zone, rack, addr, check, path, uvarint status,
+// uvarint point count, per point 8 byte big endian key and
+// uvarint node index, uvarint entry count, per entry node index
+func (s *Snapshot) Encode(w io.Writer) error {
+	var buf []byte
+	str := func(v string) {
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+	}
+	buf = append(buf, snapshotMagic...)
+	buf = append(buf, snapshotVersion)
+	buf = binary.AppendUvarint(buf, s.Epoch)
+	buf = binary.AppendUvarint(buf, s.Seed)
+	buf = binary.AppendUvarint(buf, uint64(s.Probes))
+	buf = binary.AppendUvarint(buf, uint64(s.Table))
+	str(s.Algorithm)
+	str(s.Hasher)
+	idx := make(map[string]int, len(s.Nodes))
+	buf = binary.AppendUvarint(buf, uint64(len(s.Nodes)))
+	for i, n := range s.Nodes {
+		idx[n.Name] = i
+		str(n.Name)
+		buf = binary.AppendUvarint(buf, uint64(n.Weight))
+		str(n.State)
+		str(n.Region)
+		str(n.Zone)
+		str(n.Rack)
+		str(n.Addr)
+		str(n.Check)
+		str(n.Path)
+		buf = binary.AppendUvarint(buf, uint64(n.Status))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(s.Points)))
+	for i, p := range s.Points {
+		buf = binary.BigEndian.AppendUint64(buf, s.keys[i])
+		buf = binary.AppendUvarint(buf, uint64(idx[p.Node]))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(s.Entries)))
+	for _, e := range s.Entries {
+		buf = binary.AppendUvarint(buf, uint64(e))
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// decode binary encoding, version 1 has no health checks
+func Decode(data []byte) (*Snapshot, error) {
+	rd := bytes.NewReader(data)
+	head := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(rd, head); err != nil || string(head[:4]) != snapshotMagic || head[4] < 1 || head[4] > snapshotVersion {
+		return nil, errors.New("Bad snapshot header")
+	}
+	version := head[4]
+	var err error
+	uv := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = binary.ReadUvarint(rd)
+		return v
+	}
+	str := func() string {
+		n := uv()
+		if err != nil {
+			return ""
+		}
+		if n > uint64(rd.Len()) {
+			err = io.ErrUnexpectedEOF
+			return ""
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(rd, b)
+		return string(b)
+	}
+	s := &Snapshot{}
+	s.Epoch = uv()
+	s.Seed = uv()
+	s.Probes = int(uv())
+	s.Table = int(uv())
+	s.Algorithm = str()
+	s.Hasher = str()
+	nnodes := uv()
+	for i := uint64(0); i < nnodes && err == nil; i++ {
+		n := SnapshotNode{
+			Name:   str(),
+			Weight: int(uv()),
+			State:  str(),
+			Region: str(),
+			Zone:   str(),
+			Rack:   str(),
+			Addr:   str(),
+		}
+		if version >= 2 {
+			n.Check = str()
+			n.Path = str()
+			n.Status = int(uv())
+		}
+		s.Nodes = append(s.Nodes, n)
+	}
+	node := func(idx uint64) string {
+		if err == nil && idx >= uint64(len(s.Nodes)) {
+			err = fmt.Errorf("node index %d out of range", idx)
+		}
+		if err != nil {
+			return ""
+		}
+		return s.Nodes[idx].Name
+	}
+	npoints := uv()
+	for i := uint64(0); i < npoints && err == nil; i++ {
+		var k uint64
+		if err = binary.Read(rd, binary.BigEndian, &k); err != nil {
+			break
+		}
+		name := node(uv())
+		s.keys = append(s.keys, k)
+		s.Points = append(s.Points, SnapshotPoint{fmt.Sprintf("%016x", k), name})
+	}
+	nentries := uv()
+	for i := uint64(0); i < nentries && err == nil; i++ {
+		idx := uv()
+		node(idx)
+		s.Entries = append(s.Entries, int(idx))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Bad snapshot: %s", err)
+	}
+	return s, nil
+}
+
+// ring rebuilt from a snapshot
+// the membership is replayed with the same hashing, then checked
+// point for point (and entry for entry) against the snapshot
+func FromSnapshot(s *Snapshot) (*Ring, error) {
+	if s.Hasher != "md5" || s.Seed != 0 {
+		return nil, fmt.Errorf("Unsupported hasher %s seed %d", s.Hasher, s.Seed)
+	}
+	r, err := New(Options{Algorithm: s.Algorithm, Table: s.Table, Probes: s.Probes})
+	if err != nil {
+		return nil, err
+	}
+	ops := s.Ops()
+	if len(ops) > 0 {
+		if _, err := r.Apply(ops); err != nil {
+			return nil, err
+		}
+	}
+	r.epoch = s.Epoch
+	if !r.matches(s) {
+		return nil, errors.New("Snapshot does not match its membership")
+	}
+	// history starts at the snapshot, created with its membership
+	create := r.history[0].create
+	r.history = nil
+	r.record("", create, ops...)
+	return r, nil
+}
+
+// ops rebuilding the snapshot's membership on an empty ring
+func (s *Snapshot) Ops() []Op {
+	var ops []Op
+	for _, n := range s.Nodes {
+		op := Op{Op: "add", Node: n.Name, Weight: n.Weight, State: n.State,
+			Region: n.Region, Zone: n.Zone, Rack: n.Rack, Addr: n.Addr,
+			Check: n.Check, Path: n.Path, Status: n.Status}
+		if n.State == StateDraining {
+			// draining is reached from active only
+			op.State = StateActive
+			ops = append(ops, op, Op{Op: "state", Node: n.Name, State: StateDraining})
+			continue
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// ring has the points and table entries of s
+func (r *Ring) matches(s *Snapshot) bool {
+	c := r.Snapshot()
+	if len(c.Points) != len(s.Points) || len(c.Entries) != len(s.Entries) {
+		return false
+	}
+	for i := range c.Points {
+		if c.Points[i] != s.Points[i] {
+			return false
+		}
+	}
+	for i := range c.Entries {
+		if c.Entries[i] != s.Entries[i] {
+			return false
+		}
+	}
+	return true
+}
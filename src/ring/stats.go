@@ -0,0 +1,120 @@
+// Load distribution statistics
+// keyspace share of each node from point spacing (or maglev entries),
+// optionally measured by routing synthetic keys through locate
+
+package ring
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	// keys sampled by default where points give no shares (multiprobe)
+	DefaultSamples = 100000
+	// most keys a stats request may sample
+	MaxSamples = 1000000
+)
+
+// summary of per node shares
+type balance struct {
+	min, max, mean, stddev float64
+}
+
+func summarize(shares map[string]float64) balance {
+	var b balance
+	if len(shares) == 0 {
+		return b
+	}
+	b.min = math.Inf(1)
+	for _, s := range shares {
+		b.min = math.Min(b.min, s)
+		b.max = math.Max(b.max, s)
+		b.mean += s
+	}
+	b.mean /= float64(len(shares))
+	for _, s := range shares {
+		b.stddev += (s - b.mean) * (s - b.mean)
+	}
+	b.stddev = math.Sqrt(b.stddev / float64(len(shares)))
+	return b
+}
+
+// peak to average ratio
+func (b balance) peak() float64 {
+	if b.mean == 0 {
+		return 0
+	}
+	return b.max / b.mean
+}
+
+// keyspace share per node from the ring layout
+// nil for multiprobe, whose ownership is not contiguous
+func (r *Ring) shares() map[string]float64 {
+	shares := make(map[string]float64, len(r.members))
+	switch r.algo {
+	case AlgoMultiprobe:
+		return nil
+	case AlgoMaglev:
+		for _, name := range r.names() {
+			shares[name] = 0
+		}
+		for _, e := range r.table.entry {
+			shares[r.table.nodes[e]] += 1 / float64(r.table.size)
+		}
+	default:
+		for _, name := range r.names() {
+			shares[name] = 0
+		}
+		for _, hr := range ownedRanges(r.tree) {
+			shares[hr.node] += hr.fraction()
+		}
+	}
+	return shares
+}
+
+// share of n synthetic keys routed to each node
+func (r *Ring) sample(n int) map[string]float64 {
+	shares := make(map[string]float64, len(r.members))
+	for _, name := range r.names() {
+		shares[name] = 0
+	}
+	for i := 0; i < n; i++ {
+		node := r.locate(HashKey("key"+strconv.Itoa(i)), Read)
+		if node != "" {
+			shares[node] += 1 / float64(n)
+		}
+	}
+	return shares
+}
+
+func printShares(w io.Writer, title string, names []string, shares map[string]float64) {
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, name := range names {
+		fmt.Fprintf(w, "node:%s share:%.6f\n", name, shares[name])
+	}
+	b := summarize(shares)
+	fmt.Fprintf(w, "min:%.6f max:%.6f mean:%.6f stddev:%.6f peak/avg:%.4f\n",
+		b.min, b.max, b.mean, b.stddev, b.peak())
+}
+
+// print balance stats, sampling n keys if n > 0
+func (r *Ring) PrintStats(w io.Writer, n int) {
+	names := r.names()
+	fmt.Fprintf(w, "algorithm:%s nodes:%d", r.algo, len(names))
+	if r.tree != nil {
+		fmt.Fprintf(w, " points:%d", r.tree.Len())
+	}
+	fmt.Fprintln(w)
+	if len(names) == 0 {
+		return
+	}
+	if shares := r.shares(); shares != nil {
+		printShares(w, "keyspace", names, shares)
+	}
+	if n > 0 {
+		printShares(w, fmt.Sprintf("sampled %d keys", n), names, r.sample(n))
+	}
+}
@@ -0,0 +1,90 @@
+// Topology aware replica placement
+// replicas spread over distinct zones first, distinct racks second
+
+package ring
+
+import (
+	"bptree"
+	"errors"
+)
+
+// zone and rack identities, qualified by their parents
+func (n Node) zoneID() string { return n.Region + "/" + n.Zone }
+func (n Node) rackID() string { return n.zoneID() + "/" + n.Rack }
+
+// distinct nodes usable for op clockwise from key
+func (r *Ring) walkNodes(key uint64, op Access) []*member {
+	var nodes []*member
+	seen := make(map[string]bool)
+	r.tree.Walk(bptree.Item(key), func(_ bptree.Item, v string) bool {
+		if !seen[v] {
+			seen[v] = true
+			if r.usable(v, op) {
+				nodes = append(nodes, r.members[v])
+			}
+		}
+		return len(seen) < len(r.members)
+	})
+	return nodes
+}
+
+// pick n replicas for key
+// pass 1: one node per zone, pass 2: one node per rack,
+// pass 3: any node, each pass in ring order
+func (r *Ring) Replicas(key string, n int, op Access) ([]string, error) {
+	return r.pickReplicas(HashKey(key), n, op, nil)
+}
+
+// replicas, note called for nodes passed over by a zone or rack pass
+func (r *Ring) pickReplicas(key uint64, n int, op Access, note func(name, reason string)) ([]string, error) {
+	if r.tree == nil {
+		return nil, errors.New("Not supported by " + r.algo + " ring")
+	}
+	cand := r.walkNodes(key, op)
+	if r.algo == AlgoMultiprobe && len(cand) > 0 {
+		// primary comes from the probes, rest in ring order
+		primary := r.probe(key, op)
+		for i, m := range cand {
+			if m.Name == primary {
+				copy(cand[1:i+1], cand[:i])
+				cand[0] = m
+				break
+			}
+		}
+	}
+
+	var picked []string
+	used := make(map[string]bool)
+	zones := make(map[string]bool)
+	racks := make(map[string]bool)
+	take := func(m *member) {
+		picked = append(picked, m.Name)
+		used[m.Name] = true
+		zones[m.zoneID()] = true
+		racks[m.rackID()] = true
+	}
+	for pass := 0; pass < 3 && len(picked) < n; pass++ {
+		for _, m := range cand {
+			if len(picked) == n {
+				break
+			}
+			if used[m.Name] {
+				continue
+			}
+			switch {
+			case pass == 0 && zones[m.zoneID()]:
+				if note != nil {
+					note(m.Name, "zone constraint")
+				}
+				continue
+			case pass == 1 && racks[m.rackID()]:
+				if note != nil {
+					note(m.Name, "rack constraint")
+				}
+				continue
+			}
+			take(m)
+		}
+	}
+	return picked, nil
+}
@@ -0,0 +1,56 @@
+// Atomic batch of membership changes
+// body parsing, the ops are applied by the ring
+
+package ringapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"ring"
+)
+
+const (
+	maxBatchBody = 1 << 20
+	maxBatchOps  = 10000
+)
+
+// batch request body
+type batchRequest struct {
+	Epoch *uint64   `json:"epoch"` // expected epoch, optional
+	Ops   []ring.Op `json:"ops"`
+}
+
+// parse batch request body
+func parseBatch(body []byte) (*batchRequest, error) {
+	var req batchRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("Invalid batch: %s", err)
+	}
+	if len(req.Ops) == 0 {
+		return nil, fmt.Errorf("Empty batch")
+	}
+	if len(req.Ops) > maxBatchOps {
+		return nil, fmt.Errorf("Batch too large, max %d ops", maxBatchOps)
+	}
+	return &req, nil
+}
+
+// request body up to limit bytes, false after answering
+// 413 if it is longer
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprintf(w, "Body too large, max %d bytes\n", limit)
+			return nil, false
+		}
+		fmt.Fprintf(w, "%s\n", err)
+		return nil, false
+	}
+	return body, true
+}
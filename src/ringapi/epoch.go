@@ -0,0 +1,81 @@
+// Ring epoch
+// bumped on every membership change, stamped on every response
+// lookups may require the current epoch with If-Match or ?epoch=N
+// and fail with 412 when the ring has moved on; reads against a past
+// ring ask for it with ?asof=N instead (see view)
+
+package ringapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const epochHeader = "X-Ring-Epoch"
+
+// response writer stamping the epoch header before the first write
+type epochWriter struct {
+	http.ResponseWriter
+	e       *entry
+	stamped bool
+}
+
+func (ew *epochWriter) stamp() {
+	if ew.stamped {
+		return
+	}
+	ew.stamped = true
+	if ew.e.ring != nil {
+		ew.Header().Set(epochHeader, strconv.FormatUint(ew.e.ring.Epoch(), 10))
+	}
+}
+
+func (ew *epochWriter) WriteHeader(code int) {
+	ew.stamp()
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+func (ew *epochWriter) Write(b []byte) (int, error) {
+	ew.stamp()
+	return ew.ResponseWriter.Write(b)
+}
+
+// stamp epoch in header and as the last line of text bodies,
+// other bodies carry it in their own encoding
+func withEpoch(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := entryOf(r)
+		ew := &epochWriter{ResponseWriter: w, e: e}
+		h(ew, r)
+		ct := ew.Header().Get("Content-Type")
+		if e.ring != nil && (ct == "" || strings.HasPrefix(ct, "text/plain")) {
+			fmt.Fprintf(ew, "epoch:%d\n", e.ring.Epoch())
+		}
+	}
+}
+
+// check lookup precondition against ring epoch
+// writes the error response and returns false on mismatch
+func checkEpoch(w http.ResponseWriter, r *http.Request) bool {
+	want := r.Header.Get("If-Match")
+	if want == "" {
+		want = r.URL.Query().Get("epoch")
+	}
+	if want == "" || want == "*" {
+		return true
+	}
+	epoch, err := strconv.ParseUint(strings.Trim(want, `"`), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid epoch %s\n", want)
+		return false
+	}
+	if epoch != entryOf(r).ring.Epoch() {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "Stale epoch %d\n", epoch)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+// Mountable ring API
+// the ring HTTP API as an http.Handler, for cons_hring or for
+// mounting under a prefix in another server
+
+package ringapi
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"ring"
+	"strings"
+)
+
+var ringPath = regexp.MustCompile("^/rings/([a-zA-Z0-9.]+)(/.*)?$")
+
+// handler options
+type Options struct {
+	Prefix     string                            // mount point, e.g. /internal/ring
+	Registry   *Registry                         // rings served, a new one if nil
+	Middleware []func(http.Handler) http.Handler // outermost first
+}
+
+// ring API handler
+// routes act on the default ring, /rings/{name}/... on ring name,
+// GET /rings lists rings, DELETE /rings/{name} drops one
+func NewHandler(o Options) http.Handler {
+	if o.Registry == nil {
+		o.Registry = NewRegistry()
+	}
+	reg := o.Registry
+
+	routes := http.NewServeMux()
+	routes.HandleFunc("/creat", writer(createHandler))
+	routes.HandleFunc("/add/", writer(addHandler))
+	routes.HandleFunc("/get/", reader(getHandler))
+	routes.HandleFunc("/del/", writer(delHandler))
+	routes.HandleFunc("/getN/", reader(getNHandler))
+	routes.HandleFunc("/locate/", reader(locateHandler))
+	routes.HandleFunc("/locate", reader(locateBatchHandler))
+	routes.HandleFunc("/replicas/", reader(replicasHandler))
+	routes.HandleFunc("/explain/", reader(explainHandler))
+	routes.HandleFunc("/acquire/", writer(acquireHandler))
+	routes.HandleFunc("/release/", writer(releaseHandler))
+	routes.HandleFunc("/print", reader(printHandler))
+	routes.HandleFunc("/health", reader(healthHandler))
+	routes.HandleFunc("/nodes/", nodesHandler)
+	routes.HandleFunc("/ranges", reader(rangesHandler))
+	routes.HandleFunc("/stats", reader(statsHandler))
+	routes.HandleFunc("/batch", writer(batchHandler))
+	routes.HandleFunc("/history", reader(historyHandler))
+	routes.HandleFunc("/snapshot", reader(snapshotHandler))
+	// takes the ring lock itself while streaming
+	routes.HandleFunc("/watch", watchHandler)
+	// cloning the tree takes the writer's side of the ring
+	routes.HandleFunc("/plan", writer(planHandler))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		serveRing(reg, DefaultRing, routes, w, r)
+	})
+	mux.HandleFunc("/rings", func(w http.ResponseWriter, r *http.Request) {
+		listRings(reg, w)
+	})
+	mux.HandleFunc("/rings/", func(w http.ResponseWriter, r *http.Request) {
+		m := ringPath.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			fmt.Fprintf(w, "Invalid\n")
+			return
+		}
+		if m[2] == "" || m[2] == "/" {
+			ringHandler(reg, m[1], w, r)
+			return
+		}
+		// route of the named ring
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = m[2]
+		r2.URL.RawPath = ""
+		serveRing(reg, m[1], routes, w, r2)
+	})
+
+	var h http.Handler = mux
+	if prefix := strings.TrimRight(o.Prefix, "/"); prefix != "" {
+		h = http.StripPrefix(prefix, h)
+	}
+	for i := len(o.Middleware) - 1; i >= 0; i-- {
+		h = o.Middleware[i](h)
+	}
+	return h
+}
+
+// route request to ring name, ring made on create
+// watchers get the registry entry even before the ring exists,
+// so they hear of its creation
+func serveRing(reg *Registry, name string, routes http.Handler, w http.ResponseWriter, r *http.Request) {
+	e := reg.lookup(name, r.URL.Path == "/creat" || r.URL.Path == "/watch")
+	if e == nil {
+		// not created, handlers answer accordingly
+		e = newEntry(reg.Health)
+	}
+	routes.ServeHTTP(w, withEntry(r, e))
+}
+
+// one line per ring: GET /rings
+func listRings(reg *Registry, w http.ResponseWriter) {
+	for _, name := range reg.Names() {
+		reg.Read(name, func(rg *ring.Ring) {
+			printRing(w, name, rg)
+		})
+	}
+}
+
+// GET /rings/{name} describes ring name, DELETE drops it
+func ringHandler(reg *Registry, name string, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if !reg.Read(name, func(rg *ring.Ring) { printRing(w, name, rg) }) {
+			fmt.Fprintf(w, "Ring not created\n")
+		}
+	case http.MethodDelete:
+		if !reg.remove(name) {
+			fmt.Fprintf(w, "Ring not created\n")
+			return
+		}
+		fmt.Fprintf(w, "Deleted Ring %s\n", name)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "GET or DELETE only\n")
+	}
+}
+
+func printRing(w http.ResponseWriter, name string, rg *ring.Ring) {
+	fmt.Fprintf(w, "ring:%s algorithm:%s epoch:%d nodes:%d\n", name, rg.Algorithm(), rg.Epoch(), len(rg.Nodes()))
+}
@@ -0,0 +1,683 @@
+package ringapi_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"ring"
+	"ringapi"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// test server over a fresh registry
+func newServer(t *testing.T, o ringapi.Options) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(ringapi.NewHandler(o))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// response status, headers and body of a request
+func do(t *testing.T, method, url, body string, header ...string) (int, http.Header, string) {
+	t.Helper()
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header, string(b)
+}
+
+// body of a GET
+func get(t *testing.T, url string) string {
+	t.Helper()
+	_, _, body := do(t, http.MethodGet, url, "")
+	return body
+}
+
+// first line of body
+func first(body string) string {
+	return strings.SplitN(body, "\n", 2)[0]
+}
+
+func expect(t *testing.T, url, want string) string {
+	t.Helper()
+	body := get(t, url)
+	if got := first(body); got != want {
+		t.Errorf("GET %s: got %q, want %q", url, got, want)
+	}
+	return body
+}
+
+func contains(t *testing.T, what, body, want string) {
+	t.Helper()
+	if !strings.Contains(body, want) {
+		t.Errorf("%s: %q does not contain %q", what, body, want)
+	}
+}
+
+// ring a (zone z1) and b (weight 2, zone z2) at epoch 2
+func twoNodes(t *testing.T, base string) {
+	t.Helper()
+	expect(t, base+"/creat", "Created Ring bptree")
+	expect(t, base+"/add/a?zone=z1", "Added a, key:cc175b9c0f1b6a8")
+	expect(t, base+"/add/b?weight=2&zone=z2", "Added b, key:92eb5ffee6ae2fec")
+}
+
+func TestNotCreated(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	for _, path := range []string{"/add/a", "/get/foo", "/del/a", "/getN/1", "/locate/foo",
+		"/replicas/foo", "/explain/foo", "/acquire/foo", "/release/foo", "/print", "/health",
+		"/nodes/a/state", "/nodes/a/ranges", "/ranges", "/stats", "/history", "/snapshot", "/plan"} {
+		expect(t, ts.URL+path, "Ring not created")
+	}
+	if got := get(t, ts.URL+"/rings"); got != "" {
+		t.Errorf("GET /rings: got %q, want no rings", got)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	expect(t, ts.URL+"/creat?algorithm=multiprobe&probes=5", "Created Ring multiprobe")
+	expect(t, ts.URL+"/creat?algorithm=maglev&table=7", "Created Ring maglev")
+	expect(t, ts.URL+"/creat?algorithm=nope", "Unknown algorithm nope")
+	expect(t, ts.URL+"/creat?algorithm=maglev&table=8", "Table size must be prime")
+	expect(t, ts.URL+"/creat?algorithm=multiprobe&probes=100000", "Probes must be 1 to 1024")
+	expect(t, ts.URL+"/creat?table=x", "Invalid value x")
+	expect(t, ts.URL+"/creat?algorithm=maglev&table=2147483647", "Table size must be at most 4194304")
+	// failed creates leave the last ring in place
+	expect(t, ts.URL+"/rings", "ring:default algorithm:maglev epoch:1 nodes:0")
+}
+
+func TestAddGetDel(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	expect(t, ts.URL+"/add/a%20b", "Invalid")
+	expect(t, ts.URL+"/add/c?weight=0", "Invalid value 0")
+	expect(t, ts.URL+"/add/c?weight=100000000", "Invalid weight 100000000, max 1024")
+	expect(t, ts.URL+"/add/c?check=tcp", "Health check needs addr")
+	expect(t, ts.URL+"/add/c?state=draining", "Invalid initial state draining")
+	expect(t, ts.URL+"/get/foo", "key:acbd18db4cc2f85c,val:")
+	expect(t, ts.URL+"/get/a", "key:cc175b9c0f1b6a8,val:a")
+	expect(t, ts.URL+"/del/b", "key:92eb5ffee6ae2fec,val:b")
+	expect(t, ts.URL+"/del/b", "key:92eb5ffee6ae2fec,val:")
+	expect(t, ts.URL+"/rings", "ring:default algorithm:bptree epoch:3 nodes:1")
+}
+
+func TestMaglevAddDel(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	expect(t, ts.URL+"/creat?algorithm=maglev&table=7", "Created Ring maglev")
+	// the first node takes every slot of the empty table
+	expect(t, ts.URL+"/add/a", "Added a, moved:7/7")
+	expect(t, ts.URL+"/del/a", "Deleted a:true, moved:7/7")
+	expect(t, ts.URL+"/add/a", "Added a, moved:7/7")
+}
+
+func TestReAddKeepsState(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	expect(t, ts.URL+"/nodes/a/state?state=draining", "node:a,state:draining")
+	expect(t, ts.URL+"/add/a?weight=3", "Added a, key:cc175b9c0f1b6a8")
+	expect(t, ts.URL+"/nodes/a/state", "node:a,state:draining")
+	expect(t, ts.URL+"/add/a?state=joining", "Invalid transition draining -> joining")
+	expect(t, ts.URL+"/add/a?state=active", "Added a, key:cc175b9c0f1b6a8")
+	expect(t, ts.URL+"/nodes/a/state", "node:a,state:active")
+	// the kept state replays from the history
+	expect(t, ts.URL+"/locate/foo?asof=4", "key:acbd18db4cc2f85c,node:a,state:draining,asof:4")
+}
+
+func TestGetN(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	expect(t, ts.URL+"/getN/1?n=2", "key:1,val:[a b b]")
+	expect(t, ts.URL+"/getN/foo", "Invalid key")
+}
+
+func TestLocate(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	expect(t, ts.URL+"/locate/foo", "key:acbd18db4cc2f85c,node:a,state:active")
+	expect(t, ts.URL+"/locate/foo?op=nope", "Invalid op nope")
+	expect(t, ts.URL+"/nodes/a/state?state=draining", "node:a,state:draining")
+	expect(t, ts.URL+"/locate/foo", "key:acbd18db4cc2f85c,node:a,state:draining")
+	expect(t, ts.URL+"/locate/foo?op=write", "key:acbd18db4cc2f85c,node:b,state:active")
+	expect(t, ts.URL+"/locate/foo?asof=1", "key:acbd18db4cc2f85c,node:a,state:active,asof:1")
+	expect(t, ts.URL+"/locate/foo?asof=9", "Future epoch 9")
+}
+
+func TestLocateBatch(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	code, _, body := do(t, http.MethodPost, ts.URL+"/locate", "foo\nbar\n")
+	if code != http.StatusOK || !strings.HasPrefix(body, "key:foo,node:a\nkey:bar,node:") {
+		t.Errorf("POST /locate: %d %q", code, body)
+	}
+	code, _, body = do(t, http.MethodPost, ts.URL+"/locate?replicas=2", `["foo"]`, "Content-Type", "application/json")
+	var out struct {
+		Epoch uint64
+		Keys  []ring.Located
+	}
+	if err := json.Unmarshal([]byte(body), &out); err != nil || code != http.StatusOK {
+		t.Fatalf("POST /locate json: %d %q", code, body)
+	}
+	if out.Epoch != 2 || len(out.Keys) != 1 || out.Keys[0].Node != "a" || len(out.Keys[0].Replicas) != 2 {
+		t.Errorf("POST /locate json: %+v", out)
+	}
+	if code, _, _ := do(t, http.MethodGet, ts.URL+"/locate", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /locate: %d", code)
+	}
+	keys := strings.Repeat("k\n", 100001)
+	if code, _, body := do(t, http.MethodPost, ts.URL+"/locate", keys); code != http.StatusBadRequest {
+		t.Errorf("POST /locate 100001 keys: %d %q", code, first(body))
+	}
+	big := strings.Repeat(" ", 9<<20)
+	if code, _, _ := do(t, http.MethodPost, ts.URL+"/locate", big); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST /locate 9MiB: %d", code)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	expect(t, ts.URL+"/replicas/foo?n=2", "key:acbd18db4cc2f85c,replicas:[a:active b:active]")
+	expect(t, ts.URL+"/replicas/foo?n=2&asof=1", "key:acbd18db4cc2f85c,replicas:[a:active],asof:1")
+	expect(t, ts.URL+"/replicas/foo?n=x", "Invalid value x")
+}
+
+func TestExplain(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	body := expect(t, ts.URL+"/explain/foo", "key:foo")
+	contains(t, "explain", body, "position:acbd18db4cc2f85c")
+	contains(t, "explain", body, "algorithm:bptree")
+}
+
+func TestAcquireRelease(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	expect(t, ts.URL+"/acquire/foo", "key:acbd18db4cc2f85c,node:a,load:1")
+	expect(t, ts.URL+"/release/foo", "key:acbd18db4cc2f85c,node:a,load:0")
+	expect(t, ts.URL+"/release/foo", "Not acquired foo")
+	expect(t, ts.URL+"/acquire/foo?c=0.5", "Invalid load factor 0.5")
+}
+
+func TestPrint(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	body := expect(t, ts.URL+"/print", "Min: 919145239626757800")
+	contains(t, "print", body, "919145239626757800:a")
+}
+
+func TestHealth(t *testing.T) {
+	reg := ringapi.NewRegistry()
+	reg.Health = ring.HealthConfig{Interval: 10 * time.Millisecond, Timeout: 100 * time.Millisecond, Fall: 1, Rise: 1}
+	ts := newServer(t, ringapi.Options{Registry: reg})
+	twoNodes(t, ts.URL)
+	// nothing listens on the discard port
+	expect(t, ts.URL+"/add/a?zone=z1&check=tcp&addr=127.0.0.1:9", "Added a, key:cc175b9c0f1b6a8")
+	waitFor(t, ts.URL+"/health", "a: 127.0.0.1:9 tcp down")
+	expect(t, ts.URL+"/locate/foo", "key:acbd18db4cc2f85c,node:b,state:active")
+	// a weight change keeps the node down
+	expect(t, ts.URL+"/add/a?zone=z1&weight=2&check=tcp&addr=127.0.0.1:9", "Added a, key:cc175b9c0f1b6a8")
+	body := get(t, ts.URL+"/health")
+	contains(t, "health after weight change", body, "a: 127.0.0.1:9 tcp down")
+}
+
+func TestHealthHTTP(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusNoContent)
+	var paths sync.Map
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths.Store(r.URL.Path, true)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer backend.Close()
+	addr := backend.Listener.Addr().String()
+
+	reg := ringapi.NewRegistry()
+	reg.Health = ring.HealthConfig{Interval: 10 * time.Millisecond, Timeout: time.Second, Fall: 2, Rise: 2}
+	ts := newServer(t, ringapi.Options{Registry: reg})
+	twoNodes(t, ts.URL)
+	expect(t, ts.URL+"/add/a?zone=z1&check=http&path=/hz&status=204&addr="+addr, "Added a, key:cc175b9c0f1b6a8")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := paths.Load("/hz"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("check path not probed")
+		}
+	}
+	contains(t, "health", get(t, ts.URL+"/health"), "a: "+addr+" http up fails:0")
+	expect(t, ts.URL+"/locate/foo", "key:acbd18db4cc2f85c,node:a,state:active")
+
+	// an unexpected status takes the node down after Fall probes
+	status.Store(http.StatusOK)
+	waitFor(t, ts.URL+"/health", "a: "+addr+" http down")
+	contains(t, "health", get(t, ts.URL+"/health"), "err:status 200")
+	expect(t, ts.URL+"/locate/foo", "key:acbd18db4cc2f85c,node:b,state:active")
+
+	// and back up after Rise good ones
+	status.Store(http.StatusNoContent)
+	waitFor(t, ts.URL+"/health", "a: "+addr+" http up fails:0")
+	expect(t, ts.URL+"/locate/foo", "key:acbd18db4cc2f85c,node:a,state:active")
+}
+
+// poll url until its body contains want
+func waitFor(t *testing.T, url, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		body := get(t, url)
+		if strings.Contains(body, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET %s: %q never contained %q", url, body, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	body := expect(t, ts.URL+"/ranges", "range:[92eb5ffee6ae2fec,cc175b9c0f1b6a8) node:a fraction:0.475923")
+	contains(t, "ranges", body, "node:b fraction:0.524077")
+	body = expect(t, ts.URL+"/nodes/a/ranges", "range:[92eb5ffee6ae2fec,cc175b9c0f1b6a8) node:a fraction:0.475923")
+	contains(t, "node ranges", body, "node:a fraction:0.475923")
+	expect(t, ts.URL+"/nodes/x/ranges", "Unknown node x")
+}
+
+func TestStats(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	body := expect(t, ts.URL+"/stats", "algorithm:bptree nodes:2 points:3")
+	contains(t, "stats", body, "node:a share:0.475923")
+	contains(t, "stats", get(t, ts.URL+"/stats?samples=10"), "sampled 10 keys:")
+	contains(t, "stats", get(t, ts.URL+"/stats?samples=100000000"), "sampled 1000000 keys:")
+	expect(t, ts.URL+"/stats?samples=x", "Invalid samples x")
+}
+
+func TestPlan(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	body := expect(t, ts.URL+"/plan?op=add&node=c", "range:[300103d1a3bbf95a,4a8a08f09d37b737) from:b to:c fraction:0.103653")
+	contains(t, "plan", body, "moved fraction:0.103653")
+	code, _, body := do(t, http.MethodPost, ts.URL+"/plan", `{"ops":[{"op":"add","node":"c"}]}`)
+	if code != http.StatusOK || !strings.HasPrefix(body, "range:[300103d1a3bbf95a,4a8a08f09d37b737) from:b to:c") {
+		t.Errorf("POST /plan: %d %q", code, body)
+	}
+	if code, _, _ := do(t, http.MethodPost, ts.URL+"/plan", `{"ops":[{"op":"remove","node":"x"}]}`); code != http.StatusBadRequest {
+		t.Errorf("POST /plan unknown node: %d", code)
+	}
+	// planning does not change the ring
+	expect(t, ts.URL+"/rings", "ring:default algorithm:bptree epoch:2 nodes:2")
+}
+
+func TestPlanEmpty(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	expect(t, ts.URL+"/creat", "Created Ring bptree")
+	// the first node takes the whole keyspace
+	body := expect(t, ts.URL+"/plan?op=add&node=c", "range:[4a8a08f09d37b737,4a8a08f09d37b737) from: to:c fraction:1.000000")
+	contains(t, "plan first add", body, "moved fraction:1.000000")
+	expect(t, ts.URL+"/plan?op=nope&node=c", "op 0: Unknown op \"nope\"")
+	_, _, body = do(t, http.MethodPost, ts.URL+"/plan", `{"ops":[{"op":"add","node":"a"},{"op":"add","node":"b"}]}`)
+	contains(t, "plan first batch", body, "from: to:a fraction:0.475923")
+	contains(t, "plan first batch", body, "moved fraction:1.000000")
+
+	// and the last one gives it all up
+	expect(t, ts.URL+"/add/c", "Added c, key:4a8a08f09d37b737")
+	body = expect(t, ts.URL+"/plan?op=remove&node=c", "range:[4a8a08f09d37b737,4a8a08f09d37b737) from:c to: fraction:1.000000")
+	contains(t, "plan last remove", body, "moved fraction:1.000000")
+}
+
+func TestBatch(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	code, _, body := do(t, http.MethodPost, ts.URL+"/batch",
+		`{"epoch":2,"ops":[{"op":"add","node":"c","zone":"z3"},{"op":"weight","node":"a","weight":3},{"op":"remove","node":"b"}]}`)
+	if code != http.StatusOK || first(body) != "Applied 3 ops" {
+		t.Errorf("POST /batch: %d %q", code, body)
+	}
+	expect(t, ts.URL+"/rings", "ring:default algorithm:bptree epoch:3 nodes:2")
+	code, _, body = do(t, http.MethodPost, ts.URL+"/batch", `{"epoch":2,"ops":[{"op":"remove","node":"a"}]}`)
+	if code != http.StatusPreconditionFailed || first(body) != "Stale epoch 2" {
+		t.Errorf("POST /batch stale: %d %q", code, body)
+	}
+	// all or nothing
+	code, _, body = do(t, http.MethodPost, ts.URL+"/batch", `{"ops":[{"op":"remove","node":"a"},{"op":"remove","node":"x"}]}`)
+	if code != http.StatusBadRequest || first(body) != "op 1: Unknown node x" {
+		t.Errorf("POST /batch unknown node: %d %q", code, body)
+	}
+	expect(t, ts.URL+"/rings", "ring:default algorithm:bptree epoch:3 nodes:2")
+	if code, _, _ := do(t, http.MethodPost, ts.URL+"/batch", `{"ops":[{"op":"weight","node":"a","weight":100000000}]}`); code != http.StatusBadRequest {
+		t.Errorf("POST /batch weight 1e8: %d", code)
+	}
+	if code, _, _ := do(t, http.MethodPost, ts.URL+"/batch", `{"ops":[]}`); code != http.StatusBadRequest {
+		t.Errorf("POST /batch empty: %d", code)
+	}
+	if code, _, _ := do(t, http.MethodGet, ts.URL+"/batch", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /batch: %d", code)
+	}
+	ops := strings.Repeat(`{"op":"add","node":"n"},`, 10001)
+	if code, _, _ := do(t, http.MethodPost, ts.URL+"/batch", `{"ops":[`+strings.TrimSuffix(ops, ",")+`]}`); code != http.StatusBadRequest {
+		t.Errorf("POST /batch 10001 ops: %d", code)
+	}
+	big := strings.Repeat(" ", 2<<20)
+	if code, _, _ := do(t, http.MethodPost, ts.URL+"/batch", big); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST /batch 2MiB: %d", code)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	_, _, body := do(t, http.MethodGet, ts.URL+"/history", "", "X-Actor", "ops")
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "epoch:0 ") || !strings.HasSuffix(lines[0], "create algorithm=bptree") {
+		t.Fatalf("GET /history: %q", body)
+	}
+	contains(t, "history", lines[2], "add b weight=2 state=active topo=/z2/")
+	do(t, http.MethodGet, ts.URL+"/del/a", "", "X-Actor", "alice")
+	body = get(t, ts.URL+"/history?since=3")
+	contains(t, "history since", first(body), "epoch:3 ")
+	contains(t, "history since", first(body), "actor:alice remove a")
+	expect(t, ts.URL+"/history?since=x", "Invalid epoch x")
+}
+
+func TestHistoryConcurrentLookups(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	expect(t, ts.URL+"/creat", "Created Ring bptree")
+	for i := 0; i < 16; i++ {
+		get(t, fmt.Sprintf("%s/add/n%d", ts.URL, i))
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(ts.URL + "/locate/foo?asof=15")
+			if err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	contains(t, "locate asof", get(t, ts.URL+"/locate/foo?asof=15"), ",asof:15")
+}
+
+func TestSnapshot(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	code, h, body := do(t, http.MethodGet, ts.URL+"/snapshot", "")
+	var s ring.Snapshot
+	if err := json.Unmarshal([]byte(body), &s); err != nil || code != http.StatusOK {
+		t.Fatalf("GET /snapshot: %d %q", code, body)
+	}
+	if s.Epoch != 2 || len(s.Nodes) != 2 || len(s.Points) != 3 || h.Get("ETag") != `"2-json"` {
+		t.Errorf("GET /snapshot: %+v etag %s", s, h.Get("ETag"))
+	}
+	code, h, body = do(t, http.MethodGet, ts.URL+"/snapshot", "", "Accept", ring.SnapshotBinary)
+	if code != http.StatusOK || !strings.HasPrefix(body, "CHRS") || h.Get("ETag") != `"2-bin"` {
+		t.Fatalf("GET /snapshot binary: %d %q", code, h.Get("ETag"))
+	}
+	d, err := ring.Decode([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ring.FromSnapshot(d); err != nil {
+		t.Errorf("binary snapshot: %s", err)
+	}
+	if code, _, _ := do(t, http.MethodGet, ts.URL+"/snapshot", "", "If-None-Match", `"2-json"`); code != http.StatusNotModified {
+		t.Errorf("GET /snapshot If-None-Match: %d", code)
+	}
+}
+
+func TestSnapshotKeepsChecks(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	expect(t, ts.URL+"/creat", "Created Ring bptree")
+	expect(t, ts.URL+"/add/a?check=http&addr=127.0.0.1:9&path=/hz&status=204", "Added a, key:cc175b9c0f1b6a8")
+	for _, accept := range []string{"application/json", ring.SnapshotBinary} {
+		_, _, body := do(t, http.MethodGet, ts.URL+"/snapshot", "", "Accept", accept)
+		var s *ring.Snapshot
+		var err error
+		if accept == ring.SnapshotBinary {
+			s, err = ring.Decode([]byte(body))
+		} else {
+			s = new(ring.Snapshot)
+			err = json.Unmarshal([]byte(body), s)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := s.Nodes[0]; n.Check != ring.CheckHTTP || n.Path != "/hz" || n.Status != 204 {
+			t.Errorf("%s snapshot node: %+v", accept, n)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	var poll struct {
+		Epoch  uint64
+		Events []ring.Event
+	}
+	body := get(t, ts.URL+"/watch?since=0&mode=poll")
+	if err := json.Unmarshal([]byte(body), &poll); err != nil {
+		t.Fatalf("GET /watch poll: %q", body)
+	}
+	if poll.Epoch != 2 || len(poll.Events) != 2 || poll.Events[1].Ops[0].Node != "b" {
+		t.Errorf("GET /watch poll: %+v", poll)
+	}
+
+	next := watch(t, ts.URL+"/watch?since=1")
+	if ev := next(); ev.Epoch != 2 || ev.Kind != "change" {
+		t.Errorf("watch: %+v", ev)
+	}
+	get(t, ts.URL+"/del/a")
+	if ev := next(); ev.Epoch != 3 || ev.Ops[0].Op != "remove" {
+		t.Errorf("watch: %+v", ev)
+	}
+}
+
+// open a watch stream, the func returns its next event
+func watch(t *testing.T, url string) func() ring.Event {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	sc := bufio.NewScanner(resp.Body)
+	return func() ring.Event {
+		t.Helper()
+		for sc.Scan() {
+			if l := sc.Text(); strings.HasPrefix(l, "data: ") {
+				var ev ring.Event
+				if err := json.Unmarshal([]byte(l[len("data: "):]), &ev); err != nil {
+					t.Fatal(err)
+				}
+				return ev
+			}
+		}
+		t.Fatalf("watch stream ended: %v", sc.Err())
+		return ring.Event{}
+	}
+}
+
+// watchers opened before the ring exists hear of its creation
+func TestWatchBeforeCreate(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	next := watch(t, ts.URL+"/rings/r2/watch?since=0")
+	expect(t, ts.URL+"/rings/r2/creat", "Created Ring bptree")
+	if ev := next(); ev.Kind != "snapshot" || ev.Epoch != 0 {
+		t.Errorf("watch: %+v", ev)
+	}
+	expect(t, ts.URL+"/rings/r2/add/a", "Added a, key:cc175b9c0f1b6a8")
+	if ev := next(); ev.Kind != "change" || ev.Epoch != 1 || ev.Ops[0].Node != "a" {
+		t.Errorf("watch: %+v", ev)
+	}
+	// and of its deletion and re-creation
+	do(t, http.MethodDelete, ts.URL+"/rings/r2", "")
+	expect(t, ts.URL+"/rings/r2/creat", "Created Ring bptree")
+	if ev := next(); ev.Kind != "snapshot" || ev.Epoch != 2 || len(ev.Ops) != 0 {
+		t.Errorf("watch after re-create: %+v", ev)
+	}
+}
+
+// epochs and snapshot tags of a ring never repeat across deletion
+func TestRecreateAfterDelete(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	_, h, _ := do(t, http.MethodGet, ts.URL+"/snapshot", "")
+	tag := h.Get("ETag")
+	do(t, http.MethodDelete, ts.URL+"/rings/default", "")
+	expect(t, ts.URL+"/creat", "Created Ring bptree")
+	expect(t, ts.URL+"/add/c", "Added c, key:4a8a08f09d37b737")
+	code, h, body := do(t, http.MethodGet, ts.URL+"/snapshot", "", "If-None-Match", tag)
+	if code != http.StatusOK || h.Get("ETag") != `"4-json"` {
+		t.Errorf("GET /snapshot after re-create: %d %s %q", code, h.Get("ETag"), body)
+	}
+	expect(t, ts.URL+"/locate/foo?asof=2", "No ring at epoch 2")
+}
+
+func TestNodeState(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	expect(t, ts.URL+"/nodes/a/state", "node:a,state:active")
+	expect(t, ts.URL+"/nodes/a/state?state=joining", "Invalid transition active -> joining")
+	expect(t, ts.URL+"/nodes/a/state?state=draining", "node:a,state:draining")
+	expect(t, ts.URL+"/nodes/a/state?state=removed", "node:a,state:removed")
+	expect(t, ts.URL+"/nodes/a/state", "Unknown node a")
+}
+
+func TestEpoch(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	code, h, body := do(t, http.MethodGet, ts.URL+"/locate/foo", "")
+	if code != http.StatusOK || h.Get("X-Ring-Epoch") != "2" || !strings.HasSuffix(body, "epoch:2\n") {
+		t.Errorf("GET /locate: %d %q %q", code, h.Get("X-Ring-Epoch"), body)
+	}
+	if code, _, _ := do(t, http.MethodGet, ts.URL+"/locate/foo", "", "If-Match", "1"); code != http.StatusPreconditionFailed {
+		t.Errorf("GET /locate If-Match stale: %d", code)
+	}
+	if code, _, _ := do(t, http.MethodGet, ts.URL+"/locate/foo", "", "If-Match", "2"); code != http.StatusOK {
+		t.Errorf("GET /locate If-Match current: %d", code)
+	}
+	// ?epoch= is the same precondition on every lookup, never a past ring
+	for _, path := range []string{"/get/foo", "/getN/1", "/locate/foo", "/replicas/foo", "/acquire/foo"} {
+		if code, _, body := do(t, http.MethodGet, ts.URL+path+"?epoch=1", ""); code != http.StatusPreconditionFailed || first(body) != "Stale epoch 1" {
+			t.Errorf("GET %s?epoch=1: %d %q", path, code, body)
+		}
+		if code, _, _ := do(t, http.MethodGet, ts.URL+path+"?epoch=2", ""); code != http.StatusOK {
+			t.Errorf("GET %s?epoch=2: %d", path, code)
+		}
+	}
+	if code, _, _ := do(t, http.MethodPost, ts.URL+"/locate?epoch=1", "foo\n"); code != http.StatusPreconditionFailed {
+		t.Errorf("POST /locate?epoch=1: %d", code)
+	}
+	expect(t, ts.URL+"/locate/foo?asof=1&epoch=2", "key:acbd18db4cc2f85c,node:a,state:active,asof:1")
+}
+
+func TestRings(t *testing.T) {
+	ts := newServer(t, ringapi.Options{})
+	twoNodes(t, ts.URL)
+	expect(t, ts.URL+"/rings/r2/locate/foo", "Ring not created")
+	expect(t, ts.URL+"/rings/r2/creat?algorithm=maglev&table=7", "Created Ring maglev")
+	expect(t, ts.URL+"/rings/r2/add/c", "Added c, moved:7/7")
+	expect(t, ts.URL+"/rings/r2/locate/foo", "key:acbd18db4cc2f85c,node:c,state:active")
+	body := get(t, ts.URL+"/rings")
+	if body != "ring:default algorithm:bptree epoch:2 nodes:2\nring:r2 algorithm:maglev epoch:1 nodes:1\n" {
+		t.Errorf("GET /rings: %q", body)
+	}
+	expect(t, ts.URL+"/rings/r2", "ring:r2 algorithm:maglev epoch:1 nodes:1")
+	expect(t, ts.URL+"/rings/bad!name", "Invalid")
+	if code, _, _ := do(t, http.MethodPut, ts.URL+"/rings/r2", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT /rings/r2: %d", code)
+	}
+	if _, _, body := do(t, http.MethodDelete, ts.URL+"/rings/r2", ""); first(body) != "Deleted Ring r2" {
+		t.Errorf("DELETE /rings/r2: %q", body)
+	}
+	if _, _, body := do(t, http.MethodDelete, ts.URL+"/rings/r2", ""); first(body) != "Ring not created" {
+		t.Errorf("DELETE /rings/r2 again: %q", body)
+	}
+	expect(t, ts.URL+"/rings/r2", "Ring not created")
+	expect(t, ts.URL+"/rings", "ring:default algorithm:bptree epoch:2 nodes:2")
+}
+
+func TestRegister(t *testing.T) {
+	reg := ringapi.NewRegistry()
+	r, err := ring.New(ring.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(ring.Node{Name: "x", Weight: 1}); err != nil {
+		t.Fatal(err)
+	}
+	reg.Register("built", r)
+	ts := newServer(t, ringapi.Options{Registry: reg})
+	expect(t, ts.URL+"/rings/built/locate/foo", "key:acbd18db4cc2f85c,node:x,state:active")
+	if names := reg.Names(); len(names) != 1 || names[0] != "built" {
+		t.Errorf("Names: %v", names)
+	}
+	if !reg.Read("built", func(r *ring.Ring) {}) || reg.Read("nope", func(r *ring.Ring) {}) {
+		t.Errorf("Read: wrong rings found")
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	ts := newServer(t, ringapi.Options{Prefix: "/internal/ring/"})
+	expect(t, ts.URL+"/internal/ring/creat", "Created Ring bptree")
+	expect(t, ts.URL+"/internal/ring/add/a", "Added a, key:cc175b9c0f1b6a8")
+	expect(t, ts.URL+"/internal/ring/rings/r2/creat", "Created Ring bptree")
+	expect(t, ts.URL+"/internal/ring/rings", "ring:default algorithm:bptree epoch:1 nodes:1")
+	if code, _, _ := do(t, http.MethodGet, ts.URL+"/locate/foo", ""); code != http.StatusNotFound {
+		t.Errorf("GET outside prefix: %d", code)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	var mu sync.Mutex
+	mw := func(name string) func(http.Handler) http.Handler {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				h.ServeHTTP(w, r)
+			})
+		}
+	}
+	ts := newServer(t, ringapi.Options{Prefix: "/p", Middleware: []func(http.Handler) http.Handler{mw("outer"), mw("inner")}})
+	expect(t, ts.URL+"/p/creat", "Created Ring bptree")
+	// middleware sees requests outside the prefix too
+	do(t, http.MethodGet, ts.URL+"/other", "")
+	if strings.Join(order, ",") != "outer,inner,outer,inner" {
+		t.Errorf("middleware order: %v", order)
+	}
+}
@@ -0,0 +1,708 @@
+// HTTP handlers of the ring API
+// each acts on the ring entry of its request
+
+package ringapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"ring"
+	"strconv"
+	"strings"
+)
+
+var validPath = regexp.MustCompile("^/(add|get|del|getN|locate|replicas|explain|acquire|release|/)/([a-zA-Z0-9.]+)$")
+var nodePath = regexp.MustCompile("^/nodes/([a-zA-Z0-9.]+)/(state|ranges)$")
+
+// lookup handler: shared ring lock, epoch stamped
+func reader(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := entryOf(r)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		withEpoch(h)(w, r)
+	}
+}
+
+// mutating handler: exclusive ring lock, epoch stamped
+// the ring records changes as made by the request's actor,
+// watchers are woken when the ring or its epoch changed
+func writer(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := entryOf(r)
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		prev, epoch := e.ring, uint64(0)
+		if prev != nil {
+			prev.SetActor(actor(r))
+			epoch = prev.Epoch()
+		}
+		withEpoch(h)(w, r)
+		if e.ring != prev || (e.ring != nil && e.ring.Epoch() != epoch) {
+			e.notify()
+		}
+	}
+}
+
+// create ring: /creat?algorithm=bptree|multiprobe|maglev
+// &table=65537 (maglev) &probes=21 (multiprobe)
+func createHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	q := r.URL.Query()
+	opts := ring.Options{Algorithm: q.Get("algorithm")}
+	if opts.Algorithm == "" {
+		opts.Algorithm = ring.AlgoBptree
+	}
+	var err error
+	opts.Table, err = intParam(q.Get("table"), ring.DefaultTableSize)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	opts.Probes, err = intParam(q.Get("probes"), ring.DefaultProbes)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	opts.Health = e.health
+	opts.Actor = actor(r)
+	nr, err := ring.New(opts)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if e.ring != nil {
+		// epochs stay monotonic and history is kept across re-creation
+		nr.Follow(e.ring)
+		e.ring.Close()
+	} else {
+		// and after a removed ring of the same name
+		nr.StartAt(e.next)
+	}
+	nr.Start()
+	e.ring = nr
+	fmt.Fprintf(w, "Created Ring %s\n", opts.Algorithm)
+}
+
+func addHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	m := validPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		fmt.Fprintf(w, "Invalid\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	q := r.URL.Query()
+	weight, err := intParam(q.Get("weight"), 1)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	// no state keeps the state of a present node
+	state := q.Get("state")
+	if _, err := ring.ParseInitialState(state); err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	check, err := ring.ParseCheck(q.Get("check"), q.Get("path"), q.Get("status"))
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if check.Kind != ring.CheckNone && q.Get("addr") == "" {
+		fmt.Fprintf(w, "Health check needs addr\n")
+		return
+	}
+	//cq := crc64.MakeTable(0xD5828281)
+	//fmt.Println(m[2])
+	//key := crc64.Checksum([]byte(m[2]), cq)
+	key := ring.HashKey(m[2])
+	n := ring.Node{Name: m[2], Weight: weight, State: state,
+		Region: q.Get("region"), Zone: q.Get("zone"), Rack: q.Get("rack"), Addr: q.Get("addr"), Check: check}
+	moved, err := e.ring.Add(n)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if e.ring.Algorithm() == ring.AlgoMaglev {
+		fmt.Fprintf(w, "Added %s, moved:%d/%d\n", m[2], moved, e.ring.TableSize())
+		return
+	}
+	fmt.Fprintf(w, "Added %s, key:%x\n", m[2], key)
+}
+
+func getHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	m := validPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		fmt.Fprintf(w, "Invalid\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	if !checkEpoch(w, r) {
+		return
+	}
+	//fmt.Println(m[2])
+	//cq := crc64.MakeTable(0xD5828281)
+	//key := crc64.Checksum([]byte(m[2]), cq)
+	key := ring.HashKey(m[2])
+	val, err := e.ring.Point(key)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	fmt.Fprintf(w, "key:%x,val:%s\n", key, val)
+}
+
+func delHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	m := validPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		fmt.Fprintf(w, "Invalid\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	//fmt.Println(m[2])
+	//cq := crc64.MakeTable(0xD5828281)
+	//key := crc64.Checksum([]byte(m[2]), cq)
+	key := ring.HashKey(m[2])
+	found, moved := e.ring.Remove(m[2])
+	if e.ring.Algorithm() == ring.AlgoMaglev {
+		fmt.Fprintf(w, "Deleted %s:%t, moved:%d/%d\n", m[2], found, moved, e.ring.TableSize())
+		return
+	}
+	val := ""
+	if found {
+		val = m[2]
+	}
+	fmt.Fprintf(w, "key:%x,val:%s\n", key, val)
+}
+
+func printHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	//fmt.Println(m[2])
+	e.ring.Print(w)
+}
+
+func getNHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	m := validPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		fmt.Fprintf(w, "Invalid\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	if !checkEpoch(w, r) {
+		return
+	}
+	//fmt.Println(m[2])
+	//cq := crc64.MakeTable(0xD5828281)
+	key, err := strconv.Atoi(m[2])
+	if err != nil {
+		fmt.Fprintf(w, "Invalid key\n")
+		return
+	}
+	val, err := e.ring.NextPoints(uint64(key), 3)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	fmt.Fprintf(w, "key:%d,val:%s\n", key, val)
+}
+
+// node owning hash of key: /locate/{key}?op=read|write
+// &asof=N or &at=RFC3339 answers against the ring as it was then
+func locateHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	m := validPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		fmt.Fprintf(w, "Invalid\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	if !checkEpoch(w, r) {
+		return
+	}
+	op, err := ring.ParseAccess(r.URL.Query().Get("op"))
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	v, err := view(r)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	node := v.Locate(m[2], op)
+	fmt.Fprintf(w, "key:%x,node:%s,state:%s", ring.HashKey(m[2]), node, v.NodeState(node))
+	if v != e.ring {
+		fmt.Fprintf(w, ",asof:%d", v.Epoch())
+	}
+	fmt.Fprintln(w)
+}
+
+// batch lookup: POST /locate?replicas=R&op=read|write
+// body: JSON array or newline separated keys
+// answers in key order, as JSON for a JSON body else as text
+func locateBatchHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "POST only\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	if !checkEpoch(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	op, err := ring.ParseAccess(q.Get("op"))
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	n := 0
+	if q.Get("replicas") != "" {
+		if n, err = intParam(q.Get("replicas"), 0); err != nil {
+			fmt.Fprintf(w, "%s\n", err)
+			return
+		}
+	}
+	v, err := view(r)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	body, ok := readBody(w, r, maxKeysBody)
+	if !ok {
+		return
+	}
+	ct := r.Header.Get("Content-Type")
+	keys, err := parseKeys(body, ct)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	out, err := v.LocateAll(keys, op, n)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if strings.Contains(ct, "json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Epoch uint64         `json:"epoch"`
+			Keys  []ring.Located `json:"keys"`
+		}{v.Epoch(), out})
+		return
+	}
+	for _, l := range out {
+		fmt.Fprintf(w, "key:%s,node:%s", l.Key, l.Node)
+		if n > 0 {
+			fmt.Fprintf(w, ",replicas:%s", l.Replicas)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// health check state of nodes
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	e.ring.PrintHealth(w)
+}
+
+// zone/rack spread replicas: /replicas/{key}?n=3, &asof= as locate
+func replicasHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	m := validPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		fmt.Fprintf(w, "Invalid\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	if !checkEpoch(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	n, err := intParam(q.Get("n"), 3)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	op, err := ring.ParseAccess(q.Get("op"))
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	v, err := view(r)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	nodes, err := v.Replicas(m[2], n, op)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	states := make([]string, len(nodes))
+	for i, node := range nodes {
+		states[i] = node + ":" + v.NodeState(node)
+	}
+	fmt.Fprintf(w, "key:%x,replicas:%s", ring.HashKey(m[2]), states)
+	if v != e.ring {
+		fmt.Fprintf(w, ",asof:%d", v.Epoch())
+	}
+	fmt.Fprintln(w)
+}
+
+// /nodes/{name}/state and /nodes/{name}/ranges
+func nodesHandler(w http.ResponseWriter, r *http.Request) {
+	m := nodePath.FindStringSubmatch(r.URL.Path)
+	if m != nil && m[2] == "ranges" {
+		reader(nodeRangesHandler)(w, r)
+		return
+	}
+	writer(nodeStateHandler)(w, r)
+}
+
+// hash ranges owned by node: /nodes/{name}/ranges
+func nodeRangesHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	m := nodePath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		fmt.Fprintf(w, "Invalid\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	if err := e.ring.PrintRanges(w, m[1]); err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+	}
+}
+
+// hash ranges of all nodes
+func rangesHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	if err := e.ring.PrintRanges(w, ""); err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+	}
+}
+
+// balance stats: /stats[?samples=N], N at most ring.MaxSamples
+// multiprobe rings are always sampled
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	def := 0
+	if e.ring.Algorithm() == ring.AlgoMultiprobe {
+		def = ring.DefaultSamples
+	}
+	n := def
+	if s := r.URL.Query().Get("samples"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 0 {
+			fmt.Fprintf(w, "Invalid samples %s\n", s)
+			return
+		}
+		// sampled under the read lock, keep it bounded
+		if n > ring.MaxSamples {
+			n = ring.MaxSamples
+		}
+	}
+	e.ring.PrintStats(w, n)
+}
+
+// ranges moving on a proposed change
+// GET /plan?op=add|remove|weight&node=a&weight=2&zone=...
+// POST /plan with a /batch body
+func planHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	var ops []ring.Op
+	if r.Method == http.MethodPost {
+		body, ok := readBody(w, r, maxBatchBody)
+		if !ok {
+			return
+		}
+		req, err := parseBatch(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s\n", err)
+			return
+		}
+		ops = req.Ops
+	} else {
+		q := r.URL.Query()
+		weight := 0
+		if q.Get("weight") != "" {
+			var err error
+			weight, err = intParam(q.Get("weight"), 1)
+			if err != nil {
+				fmt.Fprintf(w, "%s\n", err)
+				return
+			}
+		}
+		ops = []ring.Op{{Op: q.Get("op"), Node: q.Get("node"), Weight: weight,
+			Region: q.Get("region"), Zone: q.Get("zone"), Rack: q.Get("rack")}}
+	}
+	if err := e.ring.Plan(w, ops); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s\n", err)
+	}
+}
+
+// lookup explanation: /explain/{key}?op=read|write&n=2&replicas=R&c=1.25
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	m := validPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		fmt.Fprintf(w, "Invalid\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	q := r.URL.Query()
+	var o ring.ExplainOptions
+	var err error
+	if o.Op, err = ring.ParseAccess(q.Get("op")); err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if o.Neighbors, err = intParam(q.Get("n"), 2); err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if o.Replicas, err = intParam(q.Get("replicas"), 0); err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if q.Get("c") != "" {
+		if o.C, err = ring.ParseLoadFactor(q.Get("c")); err != nil {
+			fmt.Fprintf(w, "%s\n", err)
+			return
+		}
+	}
+	e.ring.Explain(w, m[2], o)
+}
+
+// whole ring: GET /snapshot
+// JSON, or binary with Accept: application/x-chr-snapshot
+// revalidate with If-None-Match
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	bin := wantsBinary(r)
+	etag := snapshotETag(e.ring.Epoch(), bin)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept")
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatch(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s := e.ring.Snapshot()
+	if bin {
+		w.Header().Set("Content-Type", ring.SnapshotBinary)
+		s.Encode(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// membership change history: /history[?since=epoch]
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		epoch, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			fmt.Fprintf(w, "Invalid epoch %s\n", s)
+			return
+		}
+		since = epoch
+	}
+	e.ring.PrintHistory(w, since)
+}
+
+// node state: /nodes/{name}/state[?state=active|draining|removed]
+func nodeStateHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	m := nodePath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		fmt.Fprintf(w, "Invalid\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	if state := r.URL.Query().Get("state"); state != "" {
+		if err := e.ring.SetState(m[1], state); err != nil {
+			fmt.Fprintf(w, "%s\n", err)
+			return
+		}
+	} else if _, ok := e.ring.Node(m[1]); !ok {
+		fmt.Fprintf(w, "Unknown node %s\n", m[1])
+		return
+	}
+	fmt.Fprintf(w, "node:%s,state:%s\n", m[1], e.ring.NodeState(m[1]))
+}
+
+// assign key under load cap: /acquire/{key}?c=1.25
+func acquireHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	m := validPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		fmt.Fprintf(w, "Invalid\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	if !checkEpoch(w, r) {
+		return
+	}
+	c, err := ring.ParseLoadFactor(r.URL.Query().Get("c"))
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	node, err := e.ring.Acquire(m[2], c)
+	if err != nil {
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	fmt.Fprintf(w, "key:%x,node:%s,load:%d\n", ring.HashKey(m[2]), node, e.ring.Load(node))
+}
+
+// release key assigned by acquire
+func releaseHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	m := validPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		fmt.Fprintf(w, "Invalid\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	node, ok := e.ring.Release(m[2])
+	if !ok {
+		fmt.Fprintf(w, "Not acquired %s\n", m[2])
+		return
+	}
+	fmt.Fprintf(w, "key:%x,node:%s,load:%d\n", ring.HashKey(m[2]), node, e.ring.Load(node))
+}
+
+// atomic membership changes: POST /batch
+// {"epoch":N,"ops":[{"op":"add|remove|weight","node":"a",...}]}
+// expected epoch in body or If-Match gives compare-and-swap
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	e := entryOf(r)
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "POST only\n")
+		return
+	}
+	if e.ring == nil {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	body, ok := readBody(w, r, maxBatchBody)
+	if !ok {
+		return
+	}
+	req, err := parseBatch(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if req.Epoch != nil && *req.Epoch != e.ring.Epoch() {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "Stale epoch %d\n", *req.Epoch)
+		return
+	}
+	if !checkEpoch(w, r) {
+		return
+	}
+	moved, err := e.ring.Apply(req.Ops)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s\n", err)
+		return
+	}
+	if e.ring.Algorithm() == ring.AlgoMaglev {
+		fmt.Fprintf(w, "Applied %d ops, moved:%d/%d\n", len(req.Ops), moved, e.ring.TableSize())
+		return
+	}
+	fmt.Fprintf(w, "Applied %d ops\n", len(req.Ops))
+}
+
+// parse optional positive integer query parameter
+func intParam(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("Invalid value %s", s)
+	}
+	return v, nil
+}
@@ -0,0 +1,54 @@
+// Membership change history
+// who made a change, and which past ring a lookup asks for
+
+package ringapi
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"ring"
+	"strconv"
+	"time"
+)
+
+// who made a change: X-Actor header, basic auth user or client address
+func actor(r *http.Request) string {
+	if a := r.Header.Get("X-Actor"); a != "" {
+		return a
+	}
+	if u, _, ok := r.BasicAuth(); ok {
+		return u
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ring for a lookup: current, or past one by ?asof=N or ?at=RFC3339
+// ?epoch=N stays a precondition on the current ring (checkEpoch)
+func view(req *http.Request) (*ring.Ring, error) {
+	cur := entryOf(req).ring
+	q := req.URL.Query()
+	if s := q.Get("asof"); s != "" {
+		epoch, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid epoch " + s)
+		}
+		return cur.At(epoch)
+	}
+	if s := q.Get("at"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, errors.New("Invalid time " + s)
+		}
+		epoch, err := cur.EpochAt(t)
+		if err != nil {
+			return nil, err
+		}
+		return cur.At(epoch)
+	}
+	return cur, nil
+}
@@ -0,0 +1,47 @@
+// Batch lookup
+// keys of a POST /locate body, located by the ring
+
+package ringapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxKeysBody = 8 << 20
+	maxKeys     = 100000
+)
+
+var tooManyKeys = errors.New("Too many keys, max " + strconv.Itoa(maxKeys))
+
+// keys from a JSON array or newline separated body
+func parseKeys(body []byte, contentType string) ([]string, error) {
+	trimmed := bytes.TrimSpace(body)
+	if strings.Contains(contentType, "json") || bytes.HasPrefix(trimmed, []byte("[")) {
+		var keys []string
+		if err := json.Unmarshal(trimmed, &keys); err != nil {
+			return nil, errors.New("Invalid key list: " + err.Error())
+		}
+		if len(keys) > maxKeys {
+			return nil, tooManyKeys
+		}
+		return keys, nil
+	}
+	var keys []string
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if k := strings.TrimSpace(sc.Text()); k != "" {
+			if len(keys) == maxKeys {
+				return nil, tooManyKeys
+			}
+			keys = append(keys, k)
+		}
+	}
+	return keys, sc.Err()
+}
@@ -0,0 +1,255 @@
+// Reverse proxy by consistent hash
+// requests are hashed on a key taken from the request, located on
+// a ring and forwarded to the owner's registered address; when the
+// owner cannot be dialed the next replica of the ring walk is tried
+
+package ringapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"ring"
+	"strconv"
+	"strings"
+)
+
+const (
+	nodeHeader = "X-Ring-Node"
+	// request bodies are held for replay on another replica,
+	// up to this size by default
+	DefaultMaxBody = 8 << 20
+)
+
+// proxy options
+type ProxyOptions struct {
+	Registry *Registry // rings, a new one if nil
+	Ring     string    // ring routed on, DefaultRing if empty
+	// request key: path (whole path), path:N (N-th segment from 0),
+	// query:name, header:name or cookie:name
+	Key     string
+	Retries int   // further replicas tried on dial errors
+	MaxBody int64 // limit of bodies held for replay, DefaultMaxBody if 0; 413 above
+}
+
+// where a key is taken from
+type keySource struct {
+	kind  string
+	name  string
+	index int
+}
+
+func parseKeySource(s string) (keySource, error) {
+	kind, name := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		kind, name = s[:i], s[i+1:]
+	}
+	ks := keySource{kind: kind, name: name, index: -1}
+	switch kind {
+	case "path":
+		if name == "" {
+			return ks, nil
+		}
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 0 {
+			return ks, fmt.Errorf("invalid path segment %s", name)
+		}
+		ks.index = n
+		return ks, nil
+	case "query", "header", "cookie":
+		if name == "" {
+			return ks, fmt.Errorf("%s key needs a name", kind)
+		}
+		return ks, nil
+	}
+	return ks, fmt.Errorf("invalid key source %s", s)
+}
+
+// key of req, "" if it has none
+func (ks keySource) key(req *http.Request) string {
+	switch ks.kind {
+	case "path":
+		if ks.index < 0 {
+			return req.URL.Path
+		}
+		segs := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		if ks.index < len(segs) {
+			return segs[ks.index]
+		}
+	case "query":
+		return req.URL.Query().Get(ks.name)
+	case "header":
+		return req.Header.Get(ks.name)
+	case "cookie":
+		if c, err := req.Cookie(ks.name); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// backend choices of a proxied request, owner first
+type target struct {
+	node string
+	addr string
+}
+
+type targetsKey struct{}
+
+type proxy struct {
+	reg     *Registry
+	ring    string
+	source  keySource
+	retries int
+	maxBody int64
+	rp      *httputil.ReverseProxy
+}
+
+// reverse proxy routing on ring o.Ring
+func NewProxy(o ProxyOptions) (http.Handler, error) {
+	if o.Registry == nil {
+		o.Registry = NewRegistry()
+	}
+	if o.Ring == "" {
+		o.Ring = DefaultRing
+	}
+	if o.Key == "" {
+		o.Key = "path"
+	}
+	ks, err := parseKeySource(o.Key)
+	if err != nil {
+		return nil, err
+	}
+	if o.Retries < 0 {
+		o.Retries = 0
+	}
+	if o.MaxBody <= 0 {
+		o.MaxBody = DefaultMaxBody
+	}
+	p := &proxy{reg: o.Registry, ring: o.Ring, source: ks, retries: o.Retries, maxBody: o.MaxBody}
+	p.rp = &httputil.ReverseProxy{
+		// host is set per attempt by the transport
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+		},
+		Transport: &retryTransport{base: http.DefaultTransport},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, "Backend unavailable: %s\n", err)
+		},
+	}
+	return p, nil
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := p.source.key(req)
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid request key\n")
+		return
+	}
+	op := ring.Write
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		op = ring.Read
+	}
+	var targets []target
+	found := p.reg.Read(p.ring, func(r *ring.Ring) {
+		targets = p.targets(r, key, op)
+	})
+	if !found {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "No ring %s\n", p.ring)
+		return
+	}
+	if len(targets) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "No node for key\n")
+		return
+	}
+	// keep the body for replay on another replica,
+	// a request with a single target streams it
+	if len(targets) > 1 && req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, p.maxBody))
+		req.Body.Close()
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				fmt.Fprintf(w, "Body too large, max %d bytes\n", p.maxBody)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid body\n")
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	ctx := context.WithValue(req.Context(), targetsKey{}, targets)
+	p.rp.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// owner of key and up to retries further replicas, those with an address
+// rings without a replica walk (maglev) give the owner only
+func (p *proxy) targets(r *ring.Ring, key string, op ring.Access) []target {
+	nodes, err := r.Replicas(key, p.retries+1, op)
+	if err != nil {
+		nodes = nil
+		if owner := r.Locate(key, op); owner != "" {
+			nodes = []string{owner}
+		}
+	}
+	var targets []target
+	for _, name := range nodes {
+		if n, ok := r.Node(name); ok && n.Addr != "" {
+			targets = append(targets, target{name, n.Addr})
+		}
+	}
+	return targets
+}
+
+// round tripper trying a request's targets in order,
+// moving on only when a backend cannot be dialed
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	targets, _ := req.Context().Value(targetsKey{}).([]target)
+	if len(targets) == 0 {
+		return nil, errors.New("no target")
+	}
+	var err error
+	for i, tg := range targets {
+		out := req.Clone(req.Context())
+		out.URL.Host = tg.addr
+		if i > 0 && req.GetBody != nil {
+			if out.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		var resp *http.Response
+		resp, err = t.base.RoundTrip(out)
+		if err == nil {
+			resp.Header.Set(nodeHeader, tg.node)
+			return resp, nil
+		}
+		if !dialError(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// connection to the backend never made, safe to retry elsewhere
+func dialError(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
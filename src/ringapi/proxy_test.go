@@ -0,0 +1,152 @@
+package ringapi_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"ring"
+	"ringapi"
+	"strings"
+	"testing"
+)
+
+// backend answering "name method path body"
+func newBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %s", name, r.Method, r.URL.Path, b)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// address nothing listens on
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// registry with the default ring over nodes name -> addr
+func proxyRegistry(t *testing.T, addrs map[string]string) (*ringapi.Registry, *ring.Ring) {
+	t.Helper()
+	r, err := ring.New(ring.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, addr := range addrs {
+		if _, err := r.Add(ring.Node{Name: name, Addr: addr}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reg := ringapi.NewRegistry()
+	reg.Register(ringapi.DefaultRing, r)
+	return reg, r
+}
+
+func newProxy(t *testing.T, o ringapi.ProxyOptions) *httptest.Server {
+	t.Helper()
+	p, err := ringapi.NewProxy(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(p)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// path of a key owned by node
+func pathOwnedBy(t *testing.T, r *ring.Ring, node string) string {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("/k%d", i)
+		if r.Locate(path, ring.Write) == node {
+			return path
+		}
+	}
+	t.Fatalf("no key owned by %s", node)
+	return ""
+}
+
+func TestProxyRouting(t *testing.T) {
+	a, b := newBackend(t, "a"), newBackend(t, "b")
+	reg, r := proxyRegistry(t, map[string]string{"a": a.Listener.Addr().String(), "b": b.Listener.Addr().String()})
+	ts := newProxy(t, ringapi.ProxyOptions{Registry: reg})
+	for _, node := range []string{"a", "b"} {
+		path := pathOwnedBy(t, r, node)
+		code, h, body := do(t, http.MethodPut, ts.URL+path, "v1")
+		if code != http.StatusOK || h.Get("X-Ring-Node") != node || body != node+" PUT "+path+" v1" {
+			t.Errorf("PUT %s: %d %s %q", path, code, h.Get("X-Ring-Node"), body)
+		}
+	}
+}
+
+func TestProxyKeySource(t *testing.T) {
+	a, b := newBackend(t, "a"), newBackend(t, "b")
+	reg, r := proxyRegistry(t, map[string]string{"a": a.Listener.Addr().String(), "b": b.Listener.Addr().String()})
+	ts := newProxy(t, ringapi.ProxyOptions{Registry: reg, Key: "header:X-User"})
+	want := r.Locate("alice", ring.Read)
+	code, h, _ := do(t, http.MethodGet, ts.URL+"/any", "", "X-User", "alice")
+	if code != http.StatusOK || h.Get("X-Ring-Node") != want {
+		t.Errorf("GET by header: %d %s, want %s", code, h.Get("X-Ring-Node"), want)
+	}
+	if code, _, body := do(t, http.MethodGet, ts.URL+"/any", ""); code != http.StatusBadRequest || body != "Invalid request key\n" {
+		t.Errorf("GET without key: %d %q", code, body)
+	}
+	if _, err := ringapi.NewProxy(ringapi.ProxyOptions{Key: "query"}); err == nil {
+		t.Errorf("query key without a name accepted")
+	}
+}
+
+func TestProxyRetry(t *testing.T) {
+	b := newBackend(t, "b")
+	reg, r := proxyRegistry(t, map[string]string{"a": deadAddr(t), "b": b.Listener.Addr().String()})
+	path := pathOwnedBy(t, r, "a")
+
+	ts := newProxy(t, ringapi.ProxyOptions{Registry: reg, Retries: 1})
+	// the body is replayed to the next replica
+	code, h, body := do(t, http.MethodPost, ts.URL+path, "payload")
+	if code != http.StatusOK || h.Get("X-Ring-Node") != "b" || body != "b POST "+path+" payload" {
+		t.Errorf("POST %s: %d %s %q", path, code, h.Get("X-Ring-Node"), body)
+	}
+
+	ts = newProxy(t, ringapi.ProxyOptions{Registry: reg})
+	code, _, body = do(t, http.MethodPost, ts.URL+path, "payload")
+	if code != http.StatusBadGateway || !strings.HasPrefix(body, "Backend unavailable: ") {
+		t.Errorf("POST %s without retries: %d %q", path, code, body)
+	}
+}
+
+func TestProxyMaxBody(t *testing.T) {
+	a, b := newBackend(t, "a"), newBackend(t, "b")
+	reg, r := proxyRegistry(t, map[string]string{"a": a.Listener.Addr().String(), "b": b.Listener.Addr().String()})
+	path := pathOwnedBy(t, r, "a")
+	// bodies held for a retry are limited
+	ts := newProxy(t, ringapi.ProxyOptions{Registry: reg, Retries: 1, MaxBody: 4})
+	if code, _, body := do(t, http.MethodPost, ts.URL+path, "12345"); code != http.StatusRequestEntityTooLarge || body != "Body too large, max 4 bytes\n" {
+		t.Errorf("POST 5 bytes: %d %q", code, body)
+	}
+	if code, _, body := do(t, http.MethodPost, ts.URL+path, "1234"); code != http.StatusOK || body != "a POST "+path+" 1234" {
+		t.Errorf("POST 4 bytes: %d %q", code, body)
+	}
+	// without a replica to retry the body is streamed
+	ts = newProxy(t, ringapi.ProxyOptions{Registry: reg, MaxBody: 4})
+	if code, _, body := do(t, http.MethodPost, ts.URL+path, "12345"); code != http.StatusOK || body != "a POST "+path+" 12345" {
+		t.Errorf("POST 5 bytes, no retries: %d %q", code, body)
+	}
+}
+
+func TestProxyNoRing(t *testing.T) {
+	ts := newProxy(t, ringapi.ProxyOptions{Ring: "missing"})
+	if code, _, body := do(t, http.MethodGet, ts.URL+"/k", ""); code != http.StatusServiceUnavailable || body != "No ring missing\n" {
+		t.Errorf("GET: %d %q", code, body)
+	}
+}
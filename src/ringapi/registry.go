@@ -0,0 +1,143 @@
+// Ring registry
+// named rings served by one handler, each with its own lock,
+// history and watchers
+
+package ringapi
+
+import (
+	"context"
+	"net/http"
+	"ring"
+	"sort"
+	"sync"
+)
+
+// ring served at the root of the handler
+const DefaultRing = "default"
+
+// one named ring
+type entry struct {
+	// membership changes hold the ring exclusively,
+	// lookups share it, so no lookup sees a half applied change
+	mu      sync.RWMutex
+	ring    *ring.Ring
+	health  ring.HealthConfig
+	changed chan struct{} // closed and replaced on every change, guarded by mu
+	next    uint64        // first epoch of a ring created after one was removed
+}
+
+func newEntry(health ring.HealthConfig) *entry {
+	return &entry{health: health, changed: make(chan struct{})}
+}
+
+// rings by name
+type Registry struct {
+	// health checks of rings created through the API
+	Health ring.HealthConfig
+
+	mu    sync.Mutex
+	rings map[string]*entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{Health: ring.DefaultHealth, rings: make(map[string]*entry)}
+}
+
+// entry of ring name, made if create is set
+func (g *Registry) lookup(name string, create bool) *entry {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e, ok := g.rings[name]
+	if !ok && create {
+		e = newEntry(g.Health)
+		g.rings[name] = e
+	}
+	return e
+}
+
+// serve ring r built in process under name,
+// replacing (and closing) a ring of the same name
+func (g *Registry) Register(name string, r *ring.Ring) {
+	e := g.lookup(name, true)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ring != nil {
+		e.ring.Close()
+	}
+	e.ring = r
+	e.notify()
+}
+
+// call fn with ring name held for reading,
+// false if there is no such ring
+func (g *Registry) Read(name string, fn func(*ring.Ring)) bool {
+	e := g.lookup(name, false)
+	if e == nil {
+		return false
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.ring == nil {
+		return false
+	}
+	fn(e.ring)
+	return true
+}
+
+// sorted names of created rings
+func (g *Registry) Names() []string {
+	g.mu.Lock()
+	entries := make(map[string]*entry, len(g.rings))
+	for name, e := range g.rings {
+		entries[name] = e
+	}
+	g.mu.Unlock()
+	var names []string
+	for name, e := range entries {
+		e.mu.RLock()
+		if e.ring != nil {
+			names = append(names, name)
+		}
+		e.mu.RUnlock()
+	}
+	sort.Strings(names)
+	return names
+}
+
+// drop ring name and stop its health checks
+// the entry stays, for its watchers and so that a ring created
+// under the name again goes on from the removed one's epoch
+func (g *Registry) remove(name string) bool {
+	e := g.lookup(name, false)
+	if e == nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	found := e.ring != nil
+	if found {
+		e.next = e.ring.Epoch() + 1
+		e.ring.Close()
+		e.ring = nil
+		e.notify()
+	}
+	return found
+}
+
+// wake watchers, called with mu held
+func (e *entry) notify() {
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+type entryKey struct{}
+
+// request for ring e
+func withEntry(r *http.Request, e *entry) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), entryKey{}, e))
+}
+
+// ring entry a request is for
+func entryOf(r *http.Request) *entry {
+	return r.Context().Value(entryKey{}).(*entry)
+}
@@ -0,0 +1,36 @@
+// Ring snapshot
+// content negotiation and revalidation of GET /snapshot
+
+package ringapi
+
+import (
+	"fmt"
+	"net/http"
+	"ring"
+	"strings"
+)
+
+// binary if the client accepts it, else JSON
+func wantsBinary(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, ring.SnapshotBinary) || strings.Contains(accept, "application/octet-stream")
+}
+
+// etag of the snapshot representation at epoch
+func snapshotETag(epoch uint64, binary bool) string {
+	if binary {
+		return fmt.Sprintf(`"%d-bin"`, epoch)
+	}
+	return fmt.Sprintf(`"%d-json"`, epoch)
+}
+
+// etag listed in If-None-Match
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
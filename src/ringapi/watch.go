@@ -0,0 +1,116 @@
+// Watch API
+// streams membership changes from the history as Server-Sent Events,
+// or answers a long poll; watchers too far behind get a snapshot
+
+package ringapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"ring"
+	"strconv"
+	"time"
+)
+
+const (
+	watchHeartbeat = 15 * time.Second
+	watchPollWait  = 30 * time.Second
+)
+
+// events after since, or a snapshot of the whole ring,
+// and the channel announcing the next change
+func (e *entry) pendingEvents(since uint64, snapshot bool) ([]ring.Event, <-chan struct{}, uint64, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.ring == nil {
+		return nil, e.changed, 0, false
+	}
+	if snapshot {
+		return []ring.Event{e.ring.SnapshotEvent()}, e.changed, e.ring.Epoch(), true
+	}
+	return e.ring.Events(since), e.changed, e.ring.Epoch(), true
+}
+
+// GET /watch?since=epoch[&mode=poll]
+// Server-Sent Events by default, one long poll with mode=poll
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var since uint64
+	if s := q.Get("since"); s != "" {
+		epoch, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid epoch %s\n", s)
+			return
+		}
+		since = epoch
+	} else {
+		// only changes from now on
+		_, _, since, _ = entryOf(r).pendingEvents(0, false)
+	}
+	if q.Get("mode") == "poll" {
+		longPoll(w, r, since)
+		return
+	}
+	stream(w, r, since)
+}
+
+// wait for changes after since, up to watchPollWait
+func longPoll(w http.ResponseWriter, r *http.Request, since uint64) {
+	evs, changed, epoch, ok := entryOf(r).pendingEvents(since, false)
+	if !ok {
+		fmt.Fprintf(w, "Ring not created\n")
+		return
+	}
+	if len(evs) == 0 {
+		t := time.NewTimer(watchPollWait)
+		defer t.Stop()
+		select {
+		case <-changed:
+			evs, _, epoch, _ = entryOf(r).pendingEvents(since, false)
+		case <-t.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(epochHeader, strconv.FormatUint(epoch, 10))
+	json.NewEncoder(w).Encode(struct {
+		Epoch  uint64       `json:"epoch"`
+		Events []ring.Event `json:"events"`
+	}{epoch, evs})
+}
+
+// stream events as they happen until the client goes away
+func stream(w http.ResponseWriter, r *http.Request, since uint64) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Streaming not supported\n")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ping := time.NewTicker(watchHeartbeat)
+	defer ping.Stop()
+	// a ring created (again) while watching starts with a snapshot
+	missing := false
+	for {
+		evs, changed, _, ok := entryOf(r).pendingEvents(since, missing)
+		missing = !ok
+		for _, ev := range evs {
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Epoch, ev.Kind, data)
+			since = ev.Epoch
+		}
+		f.Flush()
+		select {
+		case <-changed:
+		case <-ping.C:
+			fmt.Fprintf(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}